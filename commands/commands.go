@@ -1,32 +1,38 @@
 package commands
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/danlamanna/rivet/config"
 	"github.com/danlamanna/rivet/girder"
 	"github.com/danlamanna/rivet/transfer"
+	"github.com/danlamanna/rivet/util"
 	"github.com/danlamanna/rivet/version"
 	log "github.com/sirupsen/logrus"
 )
 
-func Configure(ctx *girder.Context) {
-	reader := bufio.NewReader(os.Stdin)
+// Configure prompts for the url and credentials of the profile, or of the default
+// profile if it has no name, adding it to the configuration file. Passwords are exchanged
+// for a token which is stored instead, or an api key if createAPIKey is set or the user
+// accepts the offer of one after logging in with a one-time password.
+func Configure(ctx *girder.Context, profile *config.Profile, createAPIKey bool) {
 	var promptedURL string
 	for {
 		fmt.Print("girder url (e.g. data.kitware.com): ")
-		promptedURL, _ = reader.ReadString('\n')
-		promptedURL = strings.TrimSpace(promptedURL)
+		promptedURL, _ = util.ReadLine(os.Stdin)
 
 		if promptedURL != "" {
 			break
 		}
 	}
 
-	validURL, err := girder.GetValidURL(promptedURL)
+	validURL, err := girder.GetValidURL(ctx, promptedURL)
 
 	if err != nil {
 		ctx.Logger.Fatal(err)
@@ -37,61 +43,174 @@ func Configure(ctx *girder.Context) {
 	if err = ctx.CheckMinimumVersion(); err != nil {
 		log.Fatal(err)
 	}
-	var promptedAuth string
-	for {
-		fmt.Print("auth credentials (e.g. username:password, token, api-key): ")
-		promptedAuth, _ = reader.ReadString('\n')
-		promptedAuth = strings.TrimSpace(promptedAuth)
-
-		if promptedAuth != "" {
-			break
+	// credentials passed with --api-key, --token, or --username aren't prompted for
+	if ctx.AuthType == "" {
+		var promptedAuth string
+		for {
+			fmt.Print("auth credentials (e.g. username:password, token, api-key): ")
+			promptedAuth, _ = util.ReadLine(os.Stdin)
+
+			if promptedAuth != "" {
+				break
+			}
+		}
+		ctx.Auth = promptedAuth
+		if ctx.AuthType, err = girder.GuessAuthType(promptedAuth); err != nil {
+			log.Fatal(err)
 		}
 	}
-	ctx.Auth = promptedAuth
+	storedAuth, storedType := ctx.Auth, ctx.AuthType
 	if err = ctx.ValidateAuth(); err != nil {
 		log.Fatal(err)
 	}
-	config.WriteDefaultProfile(promptedAuth, validURL)
+
+	if storedType == girder.AuthPassword && ctx.OTP != "" && !createAPIKey {
+		// the token will expire, after which logging in needs another one-time password
+		if util.IsTerminal(os.Stdin) {
+			createAPIKey = confirm("create an api key to store, so later logins don't need a one-time password? [Y/n]: ")
+		} else {
+			log.Info("pass --create-api-key to store an api key, so later logins don't need a one-time password")
+		}
+	}
+	if storedType == girder.AuthPassword && createAPIKey {
+		hostname, _ := os.Hostname()
+		apiKey, err := ctx.CreateAPIKey(fmt.Sprintf("rivet on %s", hostname))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the token of the login is no longer needed
+		if err := ctx.Logout(); err != nil {
+			log.Debugf("failed to delete the token of the login, err: %s", err)
+		}
+		storedAuth, storedType = apiKey, girder.AuthAPIKey
+		log.Info("stored a new api key rather than the password")
+	} else if storedType == girder.AuthPassword {
+		// ValidateAuth logged in with the password, leaving a token to store instead
+		storedAuth, storedType = ctx.Auth, girder.AuthToken
+		log.Info("stored a token rather than the password, run rivet configure again once it expires")
+	}
+	profile.URL, profile.AuthType = validURL, storedType
+	if err = config.WriteProfile(ctx, profile, storedAuth); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// confirm asks a yes or no question, which defaults to yes.
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, _ := util.ReadLine(os.Stdin)
+	answer = strings.ToLower(answer)
+	return answer == "" || answer == "y" || answer == "yes"
+}
+
+// Exit statuses of rivet. A sync which was interrupted by SIGINT or SIGTERM exits with
+// ExitInterrupted regardless of how much failed.
+const (
+	ExitSuccess     = 0
+	ExitFailure     = 1
+	ExitUsage       = 2
+	ExitAuth        = 3
+	ExitInterrupted = 130
+)
+
+// handleInterrupts cancels the context of the sync on the first SIGINT or SIGTERM, so
+// it stops starting new work and aborts transfers in progress, and exits immediately
+// on the second.
+func handleInterrupts(ctx *girder.Context) {
+	c, cancel := context.WithCancel(context.Background())
+	ctx.Ctx = c
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx.Logger.Warn("interrupted, stopping the sync. interrupt again to exit immediately")
+		cancel()
+		<-signals
+		os.Exit(ExitInterrupted)
+	}()
 }
 
-func Sync(ctx *girder.Context, source *string, dest *string) {
+// Sync syncs source to dest, one of which must be a girder location, returning the
+// exit status of the sync.
+func Sync(ctx *girder.Context, source *string, dest *string) int {
 	*source = strings.TrimSuffix(*source, "/")
 	*dest = strings.TrimSuffix(*dest, "/")
 
+	// failures before the sync starts still end the events of the sync
+	abort := func(status int, err error) int {
+		log.Error(err)
+		transfer.Abort(ctx, err)
+		return status
+	}
+
 	sourceIsGirder := strings.HasPrefix(*source, "girder://")
 	destIsGirder := strings.HasPrefix(*dest, "girder://")
 	if sourceIsGirder && destIsGirder {
-		log.Fatal("cannot sync between two girder instances")
+		return abort(ExitUsage, errors.New("cannot sync between two girder instances"))
 	} else if !sourceIsGirder && !destIsGirder {
-		log.Fatal("cannot sync between two local directories")
+		return abort(ExitUsage, errors.New("cannot sync between two local directories"))
 	}
 	if destIsGirder {
 		if stat, err := os.Stat(*source); err != nil {
 			if os.IsNotExist(err) {
-				log.Fatalf("source directory %s does not exist.\n", *source)
-			} else {
-				log.Fatalf("failed to access source directory %s, err: %s.\n", *source, err)
+				return abort(ExitUsage, fmt.Errorf("source directory %s does not exist", *source))
 			}
+			return abort(ExitFailure, fmt.Errorf("failed to access source directory %s, err: %s", *source, err))
 		} else if !stat.IsDir() {
-			log.Fatalf("source %s is not a directory.\n", *source)
+			return abort(ExitUsage, fmt.Errorf("source %s is not a directory", *source))
 		}
 	}
 
 	ctx.ResourceMap = make(girder.ResourceMap)
-	ctx.Destination = strings.TrimPrefix(*dest, "girder://")
+	handleInterrupts(ctx)
 
 	if err := ctx.CheckMinimumVersion(); err != nil {
-		log.Fatal(err)
+		return abort(ExitFailure, err)
 	}
 	if err := ctx.ValidateAuth(); err != nil {
+		if ctx.Auth != "" {
+			return abort(ExitAuth, fmt.Errorf("failed to authenticate, err: %s", err))
+		}
+		// syncing anonymously is fine if the data is public
 		log.Warn(err)
 	}
 
+	var result *transfer.Result
 	if destIsGirder {
-		transfer.Upload(ctx, *source, girder.GirderID(*dest))
-	} else if sourceIsGirder {
-		transfer.Download(ctx, girder.GirderID(strings.TrimPrefix(*source, "girder://")), *dest)
+		var folderID girder.GirderID
+		var rootType string
+		var err error
+		if ctx.DryRun && ctx.CreateDestination {
+			// creating the destination is a change, so a dry run only plans it
+			var missing []string
+			folderID, rootType, missing, err = girder.PlanLocation(ctx, *dest)
+			transfer.PlanFolders(ctx, missing)
+		} else {
+			folderID, rootType, err = girder.ResolveLocation(ctx, *dest, ctx.CreateDestination)
+		}
+		if err != nil {
+			return abort(ExitFailure, err)
+		}
+		ctx.Destination, ctx.RootType = string(folderID), rootType
+		if result, err = transfer.Upload(ctx, *source, folderID); err != nil {
+			return abort(ExitFailure, err)
+		}
+	} else {
+		folderID, rootType, err := girder.ResolveLocation(ctx, *source, false)
+		if err != nil {
+			return abort(ExitFailure, err)
+		}
+		ctx.Destination, ctx.RootType = *dest, rootType
+		result = transfer.Download(ctx, folderID, *dest)
+	}
+
+	if ctx.Interrupted() {
+		return ExitInterrupted
+	} else if !result.OK() {
+		return ExitFailure
 	}
+	return ExitSuccess
 }
 
 func Version() {
@@ -106,9 +225,13 @@ func APICreateFolder(ctx *girder.Context, dest string, path string) {
 	if err := ctx.ValidateAuth(); err != nil {
 		log.Fatal(err)
 	}
+	folderID, rootType, err := girder.ResolveLocation(ctx, dest, ctx.CreateDestination)
+	if err != nil {
+		log.Fatal(err)
+	}
 	ctx.ResourceMap = make(girder.ResourceMap)
 	ctx.ResourceMap[path] = new(girder.Resource)
-	ctx.Destination = dest
-	id, _ := girder.GetOrCreateFolderRecursive(ctx, path)
+	ctx.Destination, ctx.RootType = string(folderID), rootType
+	id, _, _ := girder.GetOrCreateFolderRecursive(ctx, path)
 	fmt.Println(id)
 }
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/danlamanna/rivet/config"
+	"github.com/danlamanna/rivet/girder"
+	log "github.com/sirupsen/logrus"
+)
+
+// Logout deletes the token cached for the profile called name, or for the default
+// profile if name is empty, from girder and then the cache.
+func Logout(ctx *girder.Context, name string) int {
+	c, err := config.Read(ctx)
+	if err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	name = profileDisplayName(c, name)
+
+	cache := config.NewTokenCache(name, "")
+	cached, err := cache.Cached()
+	if err != nil {
+		log.Errorf("failed to read cached token, err: %s", err)
+		return ExitFailure
+	} else if cached == nil {
+		fmt.Printf("no token is cached for profile %s\n", name)
+		return ExitSuccess
+	}
+
+	ctx.URL, ctx.Auth = cached.URL, cached.Token
+	if err := ctx.Logout(); err != nil {
+		// it's forgotten regardless, girder may have already expired it
+		log.Warnf("failed to delete the token from girder, err: %s", err)
+	}
+	if err := cache.Delete(); err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	fmt.Printf("logged out of profile %s\n", name)
+	return ExitSuccess
+}
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/danlamanna/rivet/config"
+	"github.com/danlamanna/rivet/girder"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProfilesList prints every configured profile, marking the default with a *.
+func ProfilesList(ctx *girder.Context) int {
+	c, err := config.Read(ctx)
+	if err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	if len(c.Profiles) == 0 {
+		fmt.Println("no profiles are configured, see rivet configure")
+		return ExitSuccess
+	}
+
+	defaultName := c.DefaultProfileName()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, profile := range c.Profiles {
+		marker := " "
+		if profile.Name == defaultName {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\n", marker, profile.Name, profile.URL)
+	}
+	w.Flush()
+	return ExitSuccess
+}
+
+// ProfilesShow prints the settings of the profile called name, or of the default
+// profile if name is empty, without revealing its credentials.
+func ProfilesShow(ctx *girder.Context, name string) int {
+	c, err := config.Read(ctx)
+	if err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	profile := c.Profile(name)
+	if profile == nil {
+		log.Errorf("profile %s does not exist, see rivet profiles list", profileDisplayName(c, name))
+		return ExitUsage
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "name\t%s\n", profile.Name)
+	fmt.Fprintf(w, "default\t%t\n", profile.Name == c.DefaultProfileName())
+	fmt.Fprintf(w, "url\t%s\n", profile.URL)
+	if profile.CredentialStore == "" || profile.CredentialStore == config.CredentialStoreConfig {
+		fmt.Fprintf(w, "auth\t%s\n", maskAuth(profile.Auth))
+	} else {
+		fmt.Fprintf(w, "credential_store\t%s\n", profile.CredentialStore)
+	}
+	if profile.CredentialHelper != "" {
+		fmt.Fprintf(w, "credential_helper\t%s\n", profile.CredentialHelper)
+	}
+	if profile.Workers != 0 {
+		fmt.Fprintf(w, "workers\t%d\n", profile.Workers)
+	}
+	if profile.FolderWorkers != 0 {
+		fmt.Fprintf(w, "folder_workers\t%d\n", profile.FolderWorkers)
+	}
+	if profile.ChunkParallelism != 0 {
+		fmt.Fprintf(w, "chunk_parallelism\t%d\n", profile.ChunkParallelism)
+	}
+	if profile.ChunkSize != "" {
+		fmt.Fprintf(w, "chunk_size\t%s\n", profile.ChunkSize)
+	}
+	w.Flush()
+	return ExitSuccess
+}
+
+// ProfilesRemove removes the profile called name from the configuration file.
+func ProfilesRemove(ctx *girder.Context, name string) int {
+	c, err := config.Read(ctx)
+	if err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	profile := c.Profile(name)
+	if profile == nil {
+		log.Errorf("profile %s does not exist, see rivet profiles list", name)
+		return ExitUsage
+	}
+	if err := config.EraseCredentials(profile); err != nil {
+		log.Warn(err)
+	}
+	if err := config.NewTokenCache(name, "").Delete(); err != nil {
+		log.Warn(err)
+	}
+	c.RemoveProfile(name)
+	if err := config.Write(c); err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	fmt.Printf("removed profile %s\n", name)
+	return ExitSuccess
+}
+
+// ProfilesSetDefault makes the profile called name the one used when none is chosen.
+func ProfilesSetDefault(ctx *girder.Context, name string) int {
+	c, err := config.Read(ctx)
+	if err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	if c.Profile(name) == nil {
+		log.Errorf("profile %s does not exist, see rivet profiles list", name)
+		return ExitUsage
+	}
+	c.DefaultProfile = name
+	if err := config.Write(c); err != nil {
+		log.Error(err)
+		return ExitFailure
+	}
+	fmt.Printf("profile %s is now the default\n", name)
+	return ExitSuccess
+}
+
+func profileDisplayName(c *config.Config, name string) string {
+	if name == "" {
+		return c.DefaultProfileName()
+	}
+	return name
+}
+
+// maskAuth hides credentials, leaving enough to tell them apart: the username of a
+// username:password pair, or the end of a token or api key.
+func maskAuth(auth string) string {
+	if auth == "" {
+		return ""
+	}
+	if i := strings.Index(auth, ":"); i != -1 {
+		return auth[:i] + ":********"
+	}
+	if len(auth) <= 8 {
+		return "********"
+	}
+	return "********" + auth[len(auth)-4:]
+}
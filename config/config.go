@@ -3,77 +3,220 @@ package config
 import (
 	"bytes"
 	"fmt"
-	"github.com/danlamanna/rivet/girder"
-	"log"
 	"os"
 	"path"
 
 	"github.com/burntsushi/toml"
+	"github.com/danlamanna/rivet/girder"
+	"github.com/danlamanna/rivet/util"
 )
 
+// DefaultProfileName is the name of the profile used when none is chosen.
+const DefaultProfileName = "default"
+
 type Config struct {
-	ConfigVersion int        `toml:"config_version"`
-	Profiles      []*Profile `toml:"profiles"`
+	ConfigVersion int `toml:"config_version"`
+
+	// DefaultProfile is the name of the profile used when none is chosen, otherwise the
+	// profile named default or the first one.
+	DefaultProfile string     `toml:"default_profile,omitempty"`
+	Profiles       []*Profile `toml:"profiles"`
 }
 
 type Profile struct {
 	Name string `toml:"name"`
 	URL  string `toml:"url"`
-	Auth string `toml:"auth"`
+	Auth string `toml:"auth,omitempty"`
+
+	// AuthType is what kind of credentials Auth is, see the girder Auth constants, guessed
+	// from their format if empty.
+	AuthType string `toml:"auth_type,omitempty"`
+
+	// CredentialStore is where Auth is kept, see the CredentialStore constants, the
+	// configuration file if empty. CredentialHelper is the command run by the helper store.
+	CredentialStore  string `toml:"credential_store,omitempty"`
+	CredentialHelper string `toml:"credential_helper,omitempty"`
+
+	// concurrency of syncs, overridden by flags and defaulted when 0
+	Workers          int    `toml:"workers,omitzero"`
+	FolderWorkers    int    `toml:"folder_workers,omitzero"`
+	ChunkParallelism int    `toml:"chunk_parallelism,omitzero"`
+	ChunkSize        string `toml:"chunk_size,omitempty"`
 }
 
-// Read the default profile and return it, or nil
-func ReadDefaultProfile(ctx *girder.Context) (*Profile, error) {
+// Dir returns the directory rivet keeps its configuration and state in
+func Dir() (string, error) {
 	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, ".rivet"), nil
+}
+
+// File returns the path of the configuration file.
+func File() (string, error) {
+	configDir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configDir, "config.toml"), nil
+}
+
+// Read the configuration file, which is empty if it doesn't exist yet.
+func Read(ctx *girder.Context) (*Config, error) {
+	config := &Config{ConfigVersion: 1}
+	configFile, err := File()
 	if err != nil {
 		return nil, err
 	}
-	config := new(Config)
-	configFile := path.Join(homeDir, ".rivet", "config.toml")
 	ctx.Logger.Debugf("attempting to load config file %s", configFile)
 	if _, err := os.Stat(configFile); err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return config, nil
 		}
 		return nil, fmt.Errorf("failed to access config file %s, err: %s", configFile, err)
 	}
+
+	if _, err = toml.DecodeFile(configFile, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s, err: %s", configFile, err)
+	}
 	ctx.Logger.Debugf("loaded config file %s", configFile)
+	return config, nil
+}
 
-	_, err = toml.DecodeFile(configFile, config)
+// Write replaces the configuration file with config.
+func Write(config *Config) error {
+	configFile, err := File()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(config); err != nil {
+		return err
 	}
+	unlock, err := Lock(configFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// only readable by the user since it may contain credentials
+	return util.WriteFileAtomic(configFile, buf.Bytes(), 0600)
+}
 
-	if len(config.Profiles) == 0 {
-		return nil, nil
+// Profile returns the profile called name, or the default profile if name is empty. nil
+// is returned if there is no such profile.
+func (c *Config) Profile(name string) *Profile {
+	if name == "" {
+		name = c.DefaultProfileName()
+	}
+	for _, profile := range c.Profiles {
+		if profile.Name == name {
+			return profile
+		}
 	}
+	return nil
+}
+
+// DefaultProfileName returns the name of the profile used when none is chosen.
+func (c *Config) DefaultProfileName() string {
+	if c.DefaultProfile != "" {
+		return c.DefaultProfile
+	}
+	for _, profile := range c.Profiles {
+		if profile.Name == DefaultProfileName {
+			return profile.Name
+		}
+	}
+	if len(c.Profiles) > 0 {
+		return c.Profiles[0].Name
+	}
+	return DefaultProfileName
+}
 
-	return config.Profiles[0], nil
+// SetProfile adds profile, replacing any profile with the same name.
+func (c *Config) SetProfile(profile *Profile) {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == profile.Name {
+			c.Profiles[i] = profile
+			return
+		}
+	}
+	c.Profiles = append(c.Profiles, profile)
+}
 
+// RemoveProfile removes the profile called name, reporting whether there was one.
+func (c *Config) RemoveProfile(name string) bool {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			c.Profiles = append(c.Profiles[:i], c.Profiles[i+1:]...)
+			if c.DefaultProfile == name {
+				c.DefaultProfile = ""
+			}
+			return true
+		}
+	}
+	return false
 }
 
-func WriteDefaultProfile(auth string, url string) error {
-	homeDir, err := os.UserHomeDir()
+// ReadProfile reads the profile called name, or the default profile if name is empty,
+// returning nil if there is no such profile. Every command reads its profile once, so
+// this is also where the permissions of the configuration file are checked.
+func ReadProfile(ctx *girder.Context, name string) (*Profile, error) {
+	config, err := Read(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	config := new(Config)
-	config.ConfigVersion = 1
-	config.Profiles = make([]*Profile, 1)
-	config.Profiles[0] = &Profile{Name: "default", URL: url, Auth: auth}
+	warnPermissions(ctx)
+	return config.Profile(name), nil
+}
 
-	configFile := path.Join(homeDir, ".rivet", "config.toml")
-	os.MkdirAll(path.Join(homeDir, ".rivet"), 0755)
-	f, err := os.Create(configFile)
-	buf := new(bytes.Buffer)
-	if err := toml.NewEncoder(buf).Encode(config); err != nil {
-		log.Fatal(err)
+// warnPermissions warns if the configuration file is accessible by other users.
+func warnPermissions(ctx *girder.Context) {
+	configFile, err := File()
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(configFile); err == nil && info.Mode().Perm()&0077 != 0 {
+		ctx.Logger.Warnf("config file %s may contain credentials but is accessible by other users (mode %04o), run chmod 600 %s",
+			configFile, info.Mode().Perm(), configFile)
 	}
-	_, err = f.Write(buf.Bytes())
+}
+
+// WriteProfile saves the url and auth type of update to the profile with the same name, or to the
+// default profile if it has no name, creating it if needed and leaving other profiles and
+// the rest of its settings as they were. auth is kept in the credential store of update,
+// or wherever the profile already keeps its credentials if update doesn't set one.
+func WriteProfile(ctx *girder.Context, update *Profile, auth string) error {
+	config, err := Read(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	name := update.Name
+	if name == "" {
+		name = config.DefaultProfileName()
+	}
+	profile := config.Profile(name)
+	if profile == nil {
+		profile = &Profile{Name: name}
+	} else if (update.CredentialStore != "" && update.CredentialStore != profile.CredentialStore) ||
+		(update.CredentialHelper != "" && update.CredentialHelper != profile.CredentialHelper) {
+		// move the credentials rather than leaving them behind
+		if err := EraseCredentials(profile); err != nil {
+			ctx.Logger.Warn(err)
+		}
 	}
 
-	defer f.Close()
-	return nil
+	profile.URL, profile.AuthType = update.URL, update.AuthType
+	if update.CredentialStore != "" {
+		profile.CredentialStore = update.CredentialStore
+	}
+	if update.CredentialHelper != "" {
+		profile.CredentialHelper = update.CredentialHelper
+	}
+	if err := StoreCredentials(profile, auth); err != nil {
+		return err
+	}
+	config.SetProfile(profile)
+	return Write(config)
 }
@@ -0,0 +1,70 @@
+package config
+
+import "testing"
+
+func profiles(names ...string) []*Profile {
+	var profiles []*Profile
+	for _, name := range names {
+		profiles = append(profiles, &Profile{Name: name})
+	}
+	return profiles
+}
+
+func TestConfig_Profile(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         *Config
+		profile        string
+		want           string
+		wantNotPresent bool
+	}{
+		{"empty", &Config{}, "", "", true},
+		{"first when no default", &Config{Profiles: profiles("a", "b")}, "", "a", false},
+		{"named default", &Config{Profiles: profiles("a", "default")}, "", "default", false},
+		{"default_profile", &Config{DefaultProfile: "b", Profiles: profiles("a", "default", "b")}, "", "b", false},
+		{"by name", &Config{DefaultProfile: "b", Profiles: profiles("a", "b")}, "a", "a", false},
+		{"missing name", &Config{Profiles: profiles("a")}, "c", "", true},
+		{"missing default_profile", &Config{DefaultProfile: "c", Profiles: profiles("a")}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.Profile(tt.profile)
+			if tt.wantNotPresent {
+				if got != nil {
+					t.Errorf("Profile(%q) = %s, want nil", tt.profile, got.Name)
+				}
+			} else if got == nil || got.Name != tt.want {
+				t.Errorf("Profile(%q) = %v, want %s", tt.profile, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_SetProfile(t *testing.T) {
+	c := &Config{Profiles: profiles("a", "b")}
+	c.SetProfile(&Profile{Name: "b", URL: "http://b"})
+	c.SetProfile(&Profile{Name: "c", URL: "http://c"})
+
+	if len(c.Profiles) != 3 {
+		t.Fatalf("got %d profiles, want 3", len(c.Profiles))
+	}
+	if c.Profiles[1].URL != "http://b" || c.Profiles[2].URL != "http://c" {
+		t.Errorf("profiles weren't replaced and added in place, got %s and %s", c.Profiles[1].URL, c.Profiles[2].URL)
+	}
+}
+
+func TestConfig_RemoveProfile(t *testing.T) {
+	c := &Config{DefaultProfile: "b", Profiles: profiles("a", "b", "c")}
+	if !c.RemoveProfile("b") {
+		t.Fatal("RemoveProfile(b) = false, want true")
+	}
+	if c.RemoveProfile("b") {
+		t.Error("RemoveProfile(b) a second time = true, want false")
+	}
+	if len(c.Profiles) != 2 || c.Profiles[0].Name != "a" || c.Profiles[1].Name != "c" {
+		t.Errorf("profiles after removing b = %v", c.Profiles)
+	}
+	if c.DefaultProfile != "" {
+		t.Errorf("DefaultProfile = %s, want it cleared", c.DefaultProfile)
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// Where the credentials of a profile are kept.
+const (
+	// CredentialStoreConfig keeps them in the configuration file itself.
+	CredentialStoreConfig = "config"
+
+	// CredentialStoreEncrypted keeps them in a credentials file encrypted with a
+	// passphrase, see encryptedStore.
+	CredentialStoreEncrypted = "encrypted"
+
+	// CredentialStoreHelper runs an external command to keep them, see helperStore.
+	CredentialStoreHelper = "helper"
+)
+
+// CredentialStores are the names of every credential store.
+var CredentialStores = []string{CredentialStoreConfig, CredentialStoreEncrypted, CredentialStoreHelper}
+
+// credentialStore keeps the credentials of profiles.
+type credentialStore interface {
+	// get returns the credentials of profile, empty if there are none.
+	get(profile *Profile) (string, error)
+	store(profile *Profile, auth string) error
+	erase(profile *Profile) error
+}
+
+type configStore struct{}
+
+func (configStore) get(profile *Profile) (string, error) {
+	return profile.Auth, nil
+}
+
+func (configStore) store(profile *Profile, auth string) error {
+	profile.Auth = auth
+	return nil
+}
+
+func (configStore) erase(profile *Profile) error {
+	profile.Auth = ""
+	return nil
+}
+
+func storeFor(profile *Profile) (credentialStore, error) {
+	switch profile.CredentialStore {
+	case "", CredentialStoreConfig:
+		return configStore{}, nil
+	case CredentialStoreEncrypted:
+		return newEncryptedStore()
+	case CredentialStoreHelper:
+		if profile.CredentialHelper == "" {
+			return nil, fmt.Errorf("profile %s uses a credential helper but doesn't set credential_helper", profile.Name)
+		}
+		return &helperStore{command: profile.CredentialHelper}, nil
+	default:
+		return nil, fmt.Errorf("profile %s has an unknown credential_store %q", profile.Name, profile.CredentialStore)
+	}
+}
+
+// ReadCredentials returns the credentials of profile from wherever they're kept.
+func ReadCredentials(ctx *girder.Context, profile *Profile) (string, error) {
+	store, err := storeFor(profile)
+	if err != nil {
+		return "", err
+	}
+	auth, err := store.get(profile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the credentials of profile %s, err: %s", profile.Name, err)
+	}
+	if isPassword(profile.AuthType, auth) {
+		ctx.Logger.Warnf("profile %s stores a password, run rivet configure --profile %s to replace it with a token", profile.Name, profile.Name)
+	}
+	return auth, nil
+}
+
+// StoreCredentials keeps auth, credentials of type profile.AuthType, as the credentials
+// of profile. The configuration file has
+// to be written afterwards, since the configuration store keeps them in profile.
+func StoreCredentials(profile *Profile, auth string) error {
+	if isPassword(profile.AuthType, auth) {
+		return fmt.Errorf("refusing to store a password for profile %s, store a token or api key instead", profile.Name)
+	}
+	store, err := storeFor(profile)
+	if err != nil {
+		return err
+	}
+	if err := store.store(profile, auth); err != nil {
+		return fmt.Errorf("failed to store the credentials of profile %s, err: %s", profile.Name, err)
+	}
+	return nil
+}
+
+// EraseCredentials removes the credentials of profile from wherever they're kept.
+func EraseCredentials(profile *Profile) error {
+	store, err := storeFor(profile)
+	if err != nil {
+		return err
+	}
+	if err := store.erase(profile); err != nil {
+		return fmt.Errorf("failed to erase the credentials of profile %s, err: %s", profile.Name, err)
+	}
+	return nil
+}
+
+// isPassword reports whether auth is a username:password pair rather than a token or
+// api key, going by its format if authType isn't known.
+func isPassword(authType string, auth string) bool {
+	if authType == "" {
+		return strings.Contains(auth, ":")
+	}
+	return authType == girder.AuthPassword
+}
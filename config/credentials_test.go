@@ -0,0 +1,108 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_encryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passphrase := "correct horse"
+	s := &encryptedStore{
+		path: path.Join(dir, "credentials.enc"),
+		passphrase: func(bool) (string, error) {
+			t.Error("asked for the passphrase before anything was stored")
+			return passphrase, nil
+		},
+	}
+	a, b := &Profile{Name: "a"}, &Profile{Name: "b"}
+	if got, err := s.get(a); err != nil || got != "" {
+		t.Errorf("get(a) before storing anything = %q, %v, want nothing", got, err)
+	}
+	if err := s.erase(a); err != nil {
+		t.Errorf("erase(a) before storing anything failed, err: %s", err)
+	}
+
+	confirmed := false
+	s.passphrase = func(confirm bool) (string, error) {
+		confirmed = confirmed || confirm
+		return passphrase, nil
+	}
+	if err := s.store(a, "token-a"); err != nil {
+		t.Fatal(err)
+	}
+	if !confirmed {
+		t.Error("the passphrase of a new credentials file wasn't confirmed")
+	}
+	if err := s.store(b, "token-b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.get(a); err != nil || got != "token-a" {
+		t.Errorf("get(a) = %q, %v, want token-a", got, err)
+	}
+
+	contents, _ := ioutil.ReadFile(s.path)
+	if strings.Contains(string(contents), "token-a") {
+		t.Error("credentials file contains plaintext credentials")
+	}
+	if info, _ := os.Stat(s.path); info.Mode().Perm() != 0600 {
+		t.Errorf("credentials file has mode %o, want 0600", info.Mode().Perm())
+	}
+
+	if err := s.erase(a); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.get(a); err != nil || got != "" {
+		t.Errorf("get(a) after erase = %q, %v, want nothing", got, err)
+	}
+	if got, err := s.get(b); err != nil || got != "token-b" {
+		t.Errorf("get(b) after erasing a = %q, %v, want token-b", got, err)
+	}
+
+	passphrase = "wrong"
+	if _, err := s.get(b); err != errWrongPassphrase {
+		t.Errorf("get with the wrong passphrase = %v, want %v", err, errWrongPassphrase)
+	}
+}
+
+func Test_helperStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// records what it's given, answering get with a password
+	helper := path.Join(dir, "helper")
+	script := "#!/bin/sh\ncat > " + path.Join(dir, "$1") + "\n[ \"$1\" = get ] && echo password=stored-token\nexit 0\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &helperStore{command: helper}
+	profile := &Profile{Name: "work", URL: "https://data.kitware.com/api/v1"}
+	if got, err := s.get(profile); err != nil || got != "stored-token" {
+		t.Errorf("get = %q, %v, want stored-token", got, err)
+	}
+	if err := s.store(profile, "new-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := ioutil.ReadFile(path.Join(dir, "store"))
+	want := "protocol=https\nhost=data.kitware.com\npath=api/v1\nusername=work\npassword=new-token\n\n"
+	if string(got) != want {
+		t.Errorf("helper was given %q, want %q", got, want)
+	}
+
+	if err := (&helperStore{command: "false"}).erase(profile); err == nil {
+		t.Error("erase with a failing helper succeeded")
+	}
+}
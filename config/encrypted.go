@@ -0,0 +1,189 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/danlamanna/rivet/util"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// pbkdf2Iterations is how many iterations are used to derive the key of new credentials
+// files, those of existing files being recorded in them.
+const pbkdf2Iterations = 200000
+
+// encryptedStore keeps credentials in $HOME/.rivet/credentials.enc, encrypted with
+// AES-256-GCM using a key derived from a passphrase. The passphrase is read from
+// RIVET_PASSPHRASE, or prompted for on the terminal.
+type encryptedStore struct {
+	path string
+
+	// passphrase returns the passphrase of the file, confirming it if the file is new.
+	passphrase func(confirm bool) (string, error)
+}
+
+// encryptedFile is the format of the credentials file, the plaintext being a JSON object
+// of credentials by profile name.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+var errWrongPassphrase = errors.New("wrong passphrase, or the credentials file is corrupt")
+
+func newEncryptedStore() (*encryptedStore, error) {
+	configDir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{path: path.Join(configDir, "credentials.enc"), passphrase: readPassphrase}, nil
+}
+
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv("RIVET_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := util.ReadPassword("passphrase for the credentials file: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the passphrase can't be empty")
+	}
+	if confirm {
+		again, err := util.ReadPassword("confirm the passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("the passphrases don't match")
+		}
+	}
+	return passphrase, nil
+}
+
+func (s *encryptedStore) get(profile *Profile) (string, error) {
+	if !s.exists() {
+		return "", nil
+	}
+	credentials, _, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	return credentials[profile.Name], nil
+}
+
+func (s *encryptedStore) store(profile *Profile, auth string) error {
+	credentials, passphrase, err := s.load()
+	if err != nil {
+		return err
+	}
+	credentials[profile.Name] = auth
+	return s.save(credentials, passphrase)
+}
+
+func (s *encryptedStore) erase(profile *Profile) error {
+	if !s.exists() {
+		return nil
+	}
+	credentials, passphrase, err := s.load()
+	if err != nil {
+		return err
+	}
+	delete(credentials, profile.Name)
+	return s.save(credentials, passphrase)
+}
+
+// exists reports whether the credentials file exists, before which nothing is stored
+// and there's no passphrase to ask for.
+func (s *encryptedStore) exists() bool {
+	_, err := os.Stat(s.path)
+	return !os.IsNotExist(err)
+}
+
+// load decrypts the credentials file, returning them along with the passphrase which
+// decrypted them. A file which doesn't exist yet has no credentials, and the passphrase
+// it'll be created with is confirmed.
+func (s *encryptedStore) load() (map[string]string, string, error) {
+	credentials := make(map[string]string)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		passphrase, err := s.passphrase(true)
+		return credentials, passphrase, err
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	f := new(encryptedFile)
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s, err: %s", s.path, err)
+	}
+	if f.Version != 1 {
+		return nil, "", fmt.Errorf("%s has unsupported version %d", s.path, f.Version)
+	}
+	passphrase, err := s.passphrase(false)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := newAEAD(passphrase, f.Salt, f.Iterations)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, "", errWrongPassphrase
+	}
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, "", errWrongPassphrase
+	}
+	return credentials, passphrase, nil
+}
+
+// save encrypts credentials with a fresh salt and nonce, replacing the credentials file.
+func (s *encryptedStore) save(credentials map[string]string, passphrase string) error {
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	f := &encryptedFile{Version: 1, Iterations: pbkdf2Iterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, f.Salt, f.Iterations)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Ciphertext = aead.Seal(nil, f.Nonce, plaintext, nil)
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.path, b, 0600)
+}
+
+func newAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	if iterations <= 0 {
+		return nil, errWrongPassphrase
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// helperStore keeps credentials with an external command, speaking the same protocol as
+// git credential helpers. The command is run by the shell with get, store, or erase
+// appended, and is passed attributes describing the profile on stdin as key=value lines.
+// The girder url is given as the protocol, host, and path, and the name of the profile
+// as the username. The credentials are the password attribute, which get prints.
+//
+// This allows git's helpers to be reused, e.g. git credential-cache or a helper for the
+// system keychain.
+type helperStore struct {
+	command string
+}
+
+func (s *helperStore) get(profile *Profile) (string, error) {
+	out, err := s.run("get", profile, "")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "password=") {
+			return strings.TrimPrefix(scanner.Text(), "password="), nil
+		}
+	}
+	return "", nil
+}
+
+func (s *helperStore) store(profile *Profile, auth string) error {
+	_, err := s.run("store", profile, auth)
+	return err
+}
+
+func (s *helperStore) erase(profile *Profile) error {
+	_, err := s.run("erase", profile, "")
+	return err
+}
+
+func (s *helperStore) run(operation string, profile *Profile, auth string) ([]byte, error) {
+	attributes, err := helperAttributes(profile, auth)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("sh", "-c", s.command+" "+operation)
+	cmd.Stdin = strings.NewReader(attributes)
+	// helpers may prompt on the terminal
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed to %s, err: %s", s.command, operation, err)
+	}
+	return out, nil
+}
+
+func helperAttributes(profile *Profile, auth string) (string, error) {
+	u, err := url.Parse(profile.URL)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "protocol=%s\n", u.Scheme)
+	fmt.Fprintf(&b, "host=%s\n", u.Host)
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		fmt.Fprintf(&b, "path=%s\n", path)
+	}
+	fmt.Fprintf(&b, "username=%s\n", profile.Name)
+	if auth != "" {
+		fmt.Fprintf(&b, "password=%s\n", auth)
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
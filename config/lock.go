@@ -0,0 +1,28 @@
+package config
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+// Lock takes an exclusive lock on file, waiting for any other run of rivet holding it,
+// so the file can be read, changed, and written without losing the changes of others.
+// The returned function releases the lock, which is also released if rivet exits.
+func Lock(file string) (func(), error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
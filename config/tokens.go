@@ -0,0 +1,198 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/danlamanna/rivet/util"
+)
+
+// TokenCache caches the most recent token of a profile in $HOME/.rivet/tokens.json, so
+// it can be reused by later runs until it expires.
+type TokenCache struct {
+	Profile string
+	URL     string
+
+	// file is where tokens are cached, tokens.json in Dir if empty
+	file string
+}
+
+// CachedToken is a token cached for a profile. Identity identifies the credentials it
+// was exchanged for, so it isn't reused for other credentials, without revealing them.
+type CachedToken struct {
+	URL      string    `json:"url"`
+	AuthType string    `json:"authType"`
+	Identity string    `json:"identity"`
+	Token    string    `json:"token"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NewTokenCache caches the tokens of the profile called name, exchanged with girder at url.
+func NewTokenCache(name string, url string) *TokenCache {
+	return &TokenCache{Profile: name, URL: url}
+}
+
+// identity identifies credentials without revealing them, even to someone guessing
+// passwords, by keying a hash of them with a random key which is only readable by the user.
+func (c *TokenCache) identity(credentials string) (string, error) {
+	key, err := c.key()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(credentials))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// key returns the key identities are hashed with, tokens.key beside the cached tokens,
+// creating it the first time it's needed.
+func (c *TokenCache) key() ([]byte, error) {
+	tokensFile, err := c.path()
+	if err != nil {
+		return nil, err
+	}
+	keyFile := path.Join(path.Dir(tokensFile), "tokens.key")
+	unlock, err := Lock(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if contents, err := ioutil.ReadFile(keyFile); err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(contents)))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := util.WriteFileAtomic(keyFile, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Get returns the cached token of credentials of type authType, nil if there isn't one.
+func (c *TokenCache) Get(authType string, credentials string) (*girder.Token, error) {
+	cached, err := c.Cached()
+	if err != nil || cached == nil {
+		return nil, err
+	}
+	id, err := c.identity(credentials)
+	if err != nil {
+		return nil, err
+	}
+	if cached.URL != c.URL || cached.AuthType != authType || !hmac.Equal([]byte(cached.Identity), []byte(id)) {
+		return nil, nil
+	}
+	return &girder.Token{Token: cached.Token, Expires: cached.Expires}, nil
+}
+
+// Put caches token as the token of the profile, replacing any it had.
+func (c *TokenCache) Put(authType string, credentials string, token *girder.Token) error {
+	id, err := c.identity(credentials)
+	if err != nil {
+		return err
+	}
+	return c.update(func(tokens map[string]*CachedToken) bool {
+		tokens[c.Profile] = &CachedToken{
+			URL:      c.URL,
+			AuthType: authType,
+			Identity: id,
+			Token:    token.Token,
+			Expires:  token.Expires,
+		}
+		return true
+	})
+}
+
+// Cached returns the token cached for the profile, whatever credentials or url it's for,
+// nil if there isn't one.
+func (c *TokenCache) Cached() (*CachedToken, error) {
+	tokensFile, err := c.path()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := loadTokens(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	return tokens[c.Profile], nil
+}
+
+// Delete removes the token cached for the profile.
+func (c *TokenCache) Delete() error {
+	return c.update(func(tokens map[string]*CachedToken) bool {
+		if _, ok := tokens[c.Profile]; !ok {
+			return false
+		}
+		delete(tokens, c.Profile)
+		return true
+	})
+}
+
+func (c *TokenCache) path() (string, error) {
+	if c.file != "" {
+		return c.file, nil
+	}
+	configDir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configDir, "tokens.json"), nil
+}
+
+// update changes the cached tokens with change, which reports whether it changed them,
+// holding a lock so concurrent runs of rivet don't undo each other's changes.
+func (c *TokenCache) update(change func(tokens map[string]*CachedToken) bool) error {
+	tokensFile, err := c.path()
+	if err != nil {
+		return err
+	}
+	unlock, err := Lock(tokensFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tokens, err := loadTokens(tokensFile)
+	if err != nil {
+		return err
+	}
+	if !change(tokens) {
+		return nil
+	}
+	return saveTokens(tokensFile, tokens)
+}
+
+func loadTokens(tokensFile string) (map[string]*CachedToken, error) {
+	tokens := make(map[string]*CachedToken)
+	contents, err := ioutil.ReadFile(tokensFile)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func saveTokens(tokensFile string, tokens map[string]*CachedToken) error {
+	contents, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(tokensFile, contents, 0600)
+}
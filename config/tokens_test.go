@@ -0,0 +1,117 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+func TestTokenCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "tokens.json")
+
+	work := &TokenCache{Profile: "work", URL: "https://a/api/v1", file: file}
+	home := &TokenCache{Profile: "home", URL: "https://b/api/v1", file: file}
+	expires := time.Now().Add(time.Hour).Round(0)
+	if err := work.Put(girder.AuthAPIKey, "key-a", &girder.Token{Token: "token-a", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err := home.Put(girder.AuthAPIKey, "key-b", &girder.Token{Token: "token-b", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := work.Get(girder.AuthAPIKey, "key-a"); err != nil || got == nil || got.Token != "token-a" || !got.Expires.Equal(expires) {
+		t.Errorf("Get(key-a) = %v, %v, want token-a", got, err)
+	}
+	if got, _ := work.Get(girder.AuthAPIKey, "key-b"); got != nil {
+		t.Errorf("Get with other credentials = %v, want nil", got)
+	}
+	if got, _ := (&TokenCache{Profile: "work", URL: "https://b/api/v1", file: file}).Get(girder.AuthAPIKey, "key-a"); got != nil {
+		t.Errorf("Get with another url = %v, want nil", got)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0600 {
+		t.Errorf("tokens file has mode %o, want 0600", info.Mode().Perm())
+	}
+
+	if err := work.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := work.Cached(); cached != nil {
+		t.Errorf("Cached after Delete = %v, want nil", cached)
+	}
+	if got, _ := home.Get(girder.AuthAPIKey, "key-b"); got == nil || got.Token != "token-b" {
+		t.Errorf("Get(key-b) after deleting another profile = %v, want token-b", got)
+	}
+}
+
+func TestTokenCache_password(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "tokens.json")
+
+	cache := &TokenCache{Profile: "work", URL: "https://a/api/v1", file: file}
+	password := "jdoe:correct horse battery staple"
+	if err := cache.Put(girder.AuthPassword, password, &girder.Token{Token: "token-a", Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(file)
+	sum := sha256.Sum256([]byte(password))
+	if strings.Contains(string(contents), "correct horse") || strings.Contains(string(contents), hex.EncodeToString(sum[:])) {
+		t.Errorf("tokens file reveals the password:\n%s", contents)
+	}
+	if got, _ := cache.Get(girder.AuthPassword, password); got == nil {
+		t.Errorf("Get with the same password = nil, want token-a")
+	}
+	if got, _ := cache.Get(girder.AuthPassword, "jsmith:correct horse battery staple"); got != nil {
+		t.Errorf("Get as another user = %v, want nil", got)
+	}
+	if got, _ := cache.Get(girder.AuthPassword, "jdoe:wrong password"); got != nil {
+		t.Errorf("Get with the wrong password = %v, want nil", got)
+	}
+	if info, err := os.Stat(path.Join(dir, "tokens.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("tokens.key = %v, %v, want a key with mode 0600", info, err)
+	}
+}
+
+func TestTokenCache_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "tokens.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache := &TokenCache{Profile: fmt.Sprintf("profile-%d", i), URL: "https://a/api/v1", file: file}
+			if err := cache.Put(girder.AuthAPIKey, "key", &girder.Token{Token: "token", Expires: time.Now().Add(time.Hour)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tokens, err := loadTokens(file)
+	if err != nil || len(tokens) != 20 {
+		t.Errorf("%d tokens were cached, want every profile's. err: %v", len(tokens), err)
+	}
+}
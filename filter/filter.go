@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFileName is the name of files containing exclusion patterns, which apply to
+// the directory they're in and everything beneath it.
+const IgnoreFileName = ".rivetignore"
+
+type rule struct {
+	base    string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// Filter decides which paths should be excluded from a sync using gitignore style
+// patterns. Patterns from ignore files are evaluated in the order they were added,
+// followed by excludes and includes passed on the command line, the last match winning.
+type Filter struct {
+	fileRules []rule
+	flagRules []rule
+}
+
+// New creates a Filter from command line patterns. Includes take precedence over
+// excludes, re-including paths which would otherwise be excluded.
+func New(includes []string, excludes []string) (*Filter, error) {
+	f := new(Filter)
+	for _, pattern := range excludes {
+		r, err := parseRule("", pattern)
+		if err != nil {
+			return nil, err
+		} else if r != nil {
+			f.flagRules = append(f.flagRules, *r)
+		}
+	}
+	for _, pattern := range includes {
+		r, err := parseRule("", "!"+strings.TrimPrefix(pattern, "!"))
+		if err != nil {
+			return nil, err
+		} else if r != nil {
+			f.flagRules = append(f.flagRules, *r)
+		}
+	}
+	return f, nil
+}
+
+// AddIgnoreFile reads patterns from an ignore file located in the directory base,
+// relative to the root of the sync.
+func (f *Filter) AddIgnoreFile(base string, reader io.Reader) error {
+	base = path.Clean(base)
+	if base == "." {
+		base = ""
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		r, err := parseRule(base, scanner.Text())
+		if err != nil {
+			return err
+		} else if r != nil {
+			f.fileRules = append(f.fileRules, *r)
+		}
+	}
+	return scanner.Err()
+}
+
+// Excluded reports whether relPath, relative to the root of the sync, should be skipped.
+func (f *Filter) Excluded(relPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	relPath = path.Clean(relPath)
+
+	excluded := false
+	for _, rules := range [][]rule{f.fileRules, f.flagRules} {
+		for _, r := range rules {
+			if r.matches(relPath, isDir) {
+				excluded = !r.negate
+			}
+		}
+	}
+	return excluded
+}
+
+func (r *rule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = strings.TrimPrefix(relPath, r.base+"/")
+	}
+	return r.re.MatchString(relPath)
+}
+
+// parseRule parses a single line of a gitignore style file, returning nil for blank
+// lines and comments.
+func parseRule(base string, line string) (*rule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	r := &rule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// patterns containing a slash are relative to the base, others match at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return nil, nil
+	}
+
+	prefix := "^(?:.*/)?"
+	if anchored {
+		prefix = "^"
+	}
+	re, err := regexp.Compile(prefix + patternToRegexp(line) + "$")
+	if err != nil {
+		return nil, err
+	}
+	r.re = re
+	return r, nil
+}
+
+func patternToRegexp(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// zero or more directories
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			// everything inside
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
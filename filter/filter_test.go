@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilter_Excluded(t *testing.T) {
+	f, err := New([]string{"keep.swp"}, []string{"build/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoreFile := `
+# comments and blank lines are ignored
+
+*.swp
+.git/
+__pycache__
+/root_only
+docs/**/*.tmp
+logs/**
+!important.log
+`
+	if err := f.AddIgnoreFile(".", strings.NewReader(ignoreFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddIgnoreFile("sub", strings.NewReader("*.dat\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a/file.swp", false, true},
+		{"a/keep.swp", false, false},
+		{".git", true, true},
+		{".git", false, false},
+		{"a/b/__pycache__", true, true},
+		{"root_only", false, true},
+		{"a/root_only", false, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"other/x.tmp", false, false},
+		{"logs", true, false},
+		{"logs/a/b", false, true},
+		{"logs/important.log", false, false},
+		{"build", true, true},
+		{"sub/x.dat", false, true},
+		{"x.dat", false, false},
+		{"plain.txt", false, false},
+	}
+	for _, tt := range tests {
+		if got := f.Excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%s, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestFilter_NilExcludesNothing(t *testing.T) {
+	var f *Filter
+	if f.Excluded("anything", false) {
+		t.Error("nil filter should not exclude anything")
+	}
+}
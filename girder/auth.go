@@ -0,0 +1,249 @@
+package girder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tokenExpiryMargin is how long before it expires a cached token stops being reused, so
+// it isn't likely to expire as soon as it's used.
+const tokenExpiryMargin = 10 * time.Minute
+
+// Token is a girder token, which may be used until it expires. Tokens given as
+// credentials have an unknown expiry, which is zero.
+type Token struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// TokenCache keeps the tokens credentials are exchanged for between runs of rivet, so
+// they can be reused rather than creating new tokens every time.
+type TokenCache interface {
+	// Get returns the cached token of credentials of type authType, nil if there isn't one.
+	Get(authType string, credentials string) (*Token, error)
+	Put(authType string, credentials string, token *Token) error
+}
+
+// Types of credentials which may be given as Auth.
+const (
+	// AuthPassword is a username:password pair, the password may contain colons.
+	AuthPassword = "password"
+	AuthAPIKey   = "api-key"
+	AuthToken    = "token"
+)
+
+// GuessAuthType guesses the type of credentials from their format, which is what's done
+// when their type isn't given: username:password pairs contain a colon, api keys are 40
+// characters, and tokens are 64.
+func GuessAuthType(credentials string) (string, error) {
+	if strings.Contains(credentials, ":") {
+		return AuthPassword, nil
+	} else if len(credentials) == 40 {
+		return AuthAPIKey, nil
+	} else if len(credentials) == 64 {
+		return AuthToken, nil
+	}
+	return "", fmt.Errorf("unable to tell what kind of credentials were given, they aren't a username:password pair, "+
+		"a 40 character api key, or a 64 character token (got %d characters). Pass them with --username, --api-key, or --token instead",
+		len(credentials))
+}
+
+// ValidateAuth exchanges the credentials in Auth for a token, reusing a cached token if
+// there's one which isn't about to expire. The credentials are of type AuthType, which
+// is guessed if it's empty.
+func (c *Context) ValidateAuth() error {
+	credentials, authType := c.Auth, c.AuthType
+	if credentials == "" {
+		return errors.New("no credentials were given")
+	} else if authType == "" {
+		var err error
+		if authType, err = GuessAuthType(credentials); err != nil {
+			return err
+		}
+	}
+
+	if c.TokenCache != nil {
+		if token, err := c.TokenCache.Get(authType, credentials); err != nil {
+			c.Logger.Warnf("failed to read cached token, err: %s", err)
+		} else if token != nil && time.Until(token.Expires) > tokenExpiryMargin {
+			c.Logger.Debugf("reusing cached token, which expires at %s", token.Expires.Local().Format(time.RFC3339))
+			c.setAuth(authType, credentials, token.Token)
+			return nil
+		}
+	}
+
+	token, err := c.exchangeCredentials(authType, credentials)
+	if err != nil {
+		return err
+	}
+	c.setAuth(authType, credentials, token.Token)
+	c.cacheToken(authType, credentials, token)
+	return nil
+}
+
+// exchangeCredentials returns a token for credentials of type authType.
+func (c *Context) exchangeCredentials(authType string, credentials string) (*Token, error) {
+	// requests are made without the current token, which may be what's being replaced
+	authCtx := &Context{URL: c.URL, Logger: c.Logger, Client: c.Client, Ctx: c.Ctx}
+
+	switch authType {
+	case AuthPassword:
+		username := strings.SplitN(credentials, ":", 2)[0]
+		token := new(GirderTokenResponse)
+		httpErr := new(GirderError)
+		authCtx.OTP = c.OTP
+		resp, err := GetBasicAuth(authCtx, credentials, "user/authentication", token, httpErr)
+		if err == nil && otpRequired(resp, httpErr) && authCtx.OTP == "" {
+			// two-factor authentication is enabled for the user, so try again with a code
+			if c.PromptOTP == nil {
+				return nil, fmt.Errorf("failed to log in as %s, girder requires a one-time password, pass it with --otp", username)
+			}
+			if c.OTP, err = c.PromptOTP(); err != nil || c.OTP == "" {
+				return nil, fmt.Errorf("failed to log in as %s, girder requires a one-time password but none was given, pass it with --otp", username)
+			}
+			authCtx.OTP = c.OTP
+			token, httpErr = new(GirderTokenResponse), new(GirderError)
+			resp, err = GetBasicAuth(authCtx, credentials, "user/authentication", token, httpErr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach girder to log in, err: %s", err)
+		} else if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && authCtx.OTP != "" {
+			return nil, fmt.Errorf("failed to log in as %s, the username, password, or one-time password is incorrect (%s)", username, httpErr)
+		} else if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("failed to log in as %s, the username or password is incorrect (%s)", username, httpErr)
+		} else if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to log in as %s, err: %s", username, httpErr)
+		}
+		c.Logger.Debugf("authenticated with username/password (user %s)", token.User.Email)
+		return token.token(), nil
+	case AuthAPIKey:
+		token := new(GirderTokenResponse)
+		httpErr := new(GirderError)
+		resp, err := Post(authCtx, fmt.Sprintf("api_key/token?key=%s", url.QueryEscape(credentials)), nil, token, httpErr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach girder to use the api key, err: %s", err)
+		} else if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("the api key was rejected, it may be wrong, inactive, or expired (%s)", httpErr)
+		} else if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to use the api key, err: %s", httpErr)
+		}
+		c.Logger.Debugf("authenticated with api key (user %s)", token.User.ID)
+		return token.token(), nil
+	case AuthToken:
+		authCtx.Auth = credentials
+		user := new(GirderUser)
+		httpErr := new(GirderError)
+		resp, err := Get(authCtx, "user/me", user, httpErr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach girder to check the token, err: %s", err)
+		} else if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to check the token, err: %s", httpErr)
+		} else if user.Email == "" {
+			// girder treats unknown tokens as no token at all, returning the "null user"
+			return nil, errors.New("the token isn't valid, it may be wrong or have expired")
+		}
+		c.Logger.Debugf("authenticated as %s", user.Email)
+		return &Token{Token: credentials}, nil
+	default:
+		return nil, fmt.Errorf("unknown type of credentials %q", authType)
+	}
+}
+
+// otpRequired reports whether a login failed only because it needs a one-time password.
+func otpRequired(resp *http.Response, httpErr *GirderError) bool {
+	return resp.StatusCode == http.StatusUnauthorized && strings.Contains(httpErr.Message, "one-time password")
+}
+
+// APIKeyScopes are the token scopes of api keys created by rivet, which are enough to
+// sync but not to do anything else with the account.
+var APIKeyScopes = []string{"core.data.read", "core.data.write", "core.data.own", "core.user_info.read"}
+
+// CreateAPIKey creates an api key called name for the user Auth is a token of, limited
+// to APIKeyScopes, and returns the key.
+func (c *Context) CreateAPIKey(name string) (string, error) {
+	scope, err := json.Marshal(APIKeyScopes)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("name", name)
+	params.Set("scope", string(scope))
+	params.Set("active", "true")
+
+	apiKey := new(GirderAPIKey)
+	httpErr := new(GirderError)
+	resp, err := Post(c, "api_key?"+params.Encode(), nil, apiKey, httpErr)
+	if err != nil {
+		return "", err
+	} else if resp.StatusCode != 200 {
+		return "", fmt.Errorf("failed to create an api key, err: %s", httpErr)
+	}
+	return apiKey.Key, nil
+}
+
+// token returns the token requests are authenticated with, which may be replaced during
+// a sync.
+func (c *Context) token() string {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	return c.Auth
+}
+
+// setAuth authenticates requests with token, which credentials of type authType were
+// exchanged for.
+func (c *Context) setAuth(authType string, credentials string, token string) {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	c.credentials, c.credentialsType = credentials, authType
+	c.Auth, c.AuthType = token, AuthToken
+}
+
+func (c *Context) cacheToken(authType string, credentials string, token *Token) {
+	if c.TokenCache == nil || token.Expires.IsZero() {
+		return
+	}
+	if err := c.TokenCache.Put(authType, credentials, token); err != nil {
+		c.Logger.Warnf("failed to cache token, err: %s", err)
+	}
+}
+
+// reauthenticate replaces stale, a token which girder no longer accepts, by exchanging
+// the credentials again. It reports whether the token was replaced, which it can't be if
+// the credentials were the token, and is only done once however many requests find the
+// token stale.
+func (c *Context) reauthenticate(stale string) (bool, error) {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	if c.Auth != stale {
+		return true, nil
+	} else if c.credentials == "" || c.credentialsType == AuthToken {
+		return false, nil
+	}
+
+	c.Logger.Info("token was rejected, it may have expired. authenticating again")
+	token, err := c.exchangeCredentials(c.credentialsType, c.credentials)
+	if err != nil {
+		return false, fmt.Errorf("failed to authenticate again, err: %s", err)
+	}
+	c.Auth = token.Token
+	c.cacheToken(c.credentialsType, c.credentials, token)
+	return true, nil
+}
+
+// Logout deletes the token requests are authenticated with from girder.
+func (c *Context) Logout() error {
+	httpErr := new(GirderError)
+	resp, err := Delete(c, "token/session", nil, httpErr)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != 200 {
+		return httpErr
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package girder
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type memoryTokenCache map[string]*Token
+
+func (c memoryTokenCache) Get(authType string, credentials string) (*Token, error) {
+	return c[credentials], nil
+}
+
+func (c memoryTokenCache) Put(authType string, credentials string, token *Token) error {
+	c[credentials] = token
+	return nil
+}
+
+// authServer issues numbered tokens for an api key, only accepting the most recent.
+type authServer struct {
+	sync.Mutex
+	issued int
+}
+
+func (s *authServer) current() string {
+	return fmt.Sprintf("%064d", s.issued)
+}
+
+func (s *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.URL.Path == "/api_key/token" {
+		s.issued++
+		expires := time.Now().Add(time.Hour).UTC().Format("2006-01-02T15:04:05.000000+00:00")
+		fmt.Fprintf(w, `{"authToken": {"token": "%s", "expires": "%s"}}`, s.current(), expires)
+	} else if r.Header.Get("Girder-Token") != s.current() {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message": "You must be logged in."}`)
+	} else {
+		fmt.Fprint(w, `{"email": "a@b.c"}`)
+	}
+}
+
+func newAuthContext(url string) *Context {
+	ctx := &Context{URL: url, Logger: logrus.New()}
+	ctx.Client = NewClient(ctx, ClientOptions{Retries: 0, RetryWaitMax: time.Millisecond, Timeout: time.Second})
+	return ctx
+}
+
+func TestContext_ValidateAuth_tokenCache(t *testing.T) {
+	s := new(authServer)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	apiKey := fmt.Sprintf("%040d", 1)
+	cache := make(memoryTokenCache)
+	for i := 0; i < 3; i++ {
+		ctx := newAuthContext(server.URL)
+		ctx.TokenCache = cache
+		ctx.Auth = apiKey
+		if err := ctx.ValidateAuth(); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.Auth != s.current() {
+			t.Errorf("run %d authenticated with %s, want %s", i, ctx.Auth, s.current())
+		}
+	}
+	if s.issued != 1 {
+		t.Errorf("%d tokens were issued, want the first to be reused", s.issued)
+	}
+
+	// a token which is about to expire isn't reused
+	cache[apiKey].Expires = time.Now().Add(time.Minute)
+	ctx := newAuthContext(server.URL)
+	ctx.TokenCache = cache
+	ctx.Auth = apiKey
+	if err := ctx.ValidateAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if s.issued != 2 || cache[apiKey].Token != s.current() {
+		t.Errorf("expiring token wasn't replaced, %d tokens issued", s.issued)
+	}
+}
+
+func TestContext_reauthenticate(t *testing.T) {
+	s := new(authServer)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	ctx := newAuthContext(server.URL)
+	ctx.Auth = fmt.Sprintf("%040d", 1)
+	if err := ctx.ValidateAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	// girder stops accepting the token, as if it expired
+	s.Lock()
+	s.issued++
+	s.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := Get(ctx, "user/me", new(GirderUser), new(GirderError))
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Errorf("request after the token expired = %v, %v", resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if s.issued != 3 {
+		t.Errorf("%d tokens were issued, want one more after the token expired", s.issued)
+	}
+
+	// a token given as the credentials can't be replaced
+	tokenCtx := newAuthContext(server.URL)
+	tokenCtx.setAuth(AuthToken, s.current(), s.current())
+	s.Lock()
+	s.issued++
+	s.Unlock()
+	resp, err := Get(tokenCtx, "user/me", new(GirderUser), new(GirderError))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request with an expired token credential = %v, %v, want unauthorized", resp, err)
+	}
+}
+
+func TestGuessAuthType(t *testing.T) {
+	tests := []struct {
+		credentials string
+		want        string
+		wantErr     bool
+	}{
+		{"jdoe:hunter2", AuthPassword, false},
+		{"jdoe:pass:with:colons", AuthPassword, false},
+		{fmt.Sprintf("%040d", 0), AuthAPIKey, false},
+		{fmt.Sprintf("%064d", 0), AuthToken, false},
+		{"short-api-key", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := GuessAuthType(tt.credentials)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("GuessAuthType(%q) = %q, %v, want %q (error %v)", tt.credentials, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestContext_ValidateAuth_otp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Girder-OTP") != "123456" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "User authentication must include a one-time password (typically in the \"Girder-OTP\" header)."}`)
+			return
+		}
+		fmt.Fprintf(w, `{"authToken": {"token": "%064d"}}`, 1)
+	}))
+	defer server.Close()
+
+	ctx := newAuthContext(server.URL)
+	ctx.Auth = "jdoe:hunter2"
+	if err := ctx.ValidateAuth(); err == nil || !strings.Contains(err.Error(), "--otp") {
+		t.Errorf("ValidateAuth without a one-time password = %v, want an error suggesting --otp", err)
+	}
+
+	prompts := 0
+	ctx = newAuthContext(server.URL)
+	ctx.Auth = "jdoe:hunter2"
+	ctx.PromptOTP = func() (string, error) {
+		prompts++
+		return "123456", nil
+	}
+	if err := ctx.ValidateAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if prompts != 1 || ctx.OTP != "123456" || ctx.Auth != fmt.Sprintf("%064d", 1) {
+		t.Errorf("after prompting %d times, OTP = %q and Auth = %q", prompts, ctx.OTP, ctx.Auth)
+	}
+
+	ctx = newAuthContext(server.URL)
+	ctx.Auth, ctx.OTP = "jdoe:hunter2", "654321"
+	ctx.PromptOTP = func() (string, error) {
+		t.Error("prompted for a one-time password when one was given")
+		return "", nil
+	}
+	if err := ctx.ValidateAuth(); err == nil || !strings.Contains(err.Error(), "one-time password is incorrect") {
+		t.Errorf("ValidateAuth with the wrong one-time password = %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package girder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danlamanna/rivet/util"
+)
+
+// BandwidthSchedule is the most bytes per second which may be transferred, depending on
+// the time of day. A rate of 0 is unlimited.
+type BandwidthSchedule struct {
+	windows []bandwidthWindow
+	rate    int64
+}
+
+// bandwidthWindow is a rate which applies from start until end, in minutes since midnight.
+// Windows which end before they start span midnight.
+type bandwidthWindow struct {
+	start, end int
+	rate       int64
+}
+
+// ParseBandwidthSchedule parses a limit such as 20M, or a comma separated schedule such as
+// 08:00-18:00=5M,off where times of day are followed by the rate which applies during them
+// and a rate on its own applies at any other time. off is unlimited.
+func ParseBandwidthSchedule(s string) (*BandwidthSchedule, error) {
+	schedule := new(BandwidthSchedule)
+	for _, entry := range strings.Split(s, ",") {
+		window, rateStr := "", strings.TrimSpace(entry)
+		if i := strings.Index(rateStr, "="); i != -1 {
+			window, rateStr = rateStr[:i], rateStr[i+1:]
+		}
+
+		rate, err := parseRate(rateStr)
+		if err != nil {
+			return nil, err
+		}
+		if window == "" {
+			schedule.rate = rate
+			continue
+		}
+
+		times := strings.Split(window, "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth window %q, expected a time range such as 08:00-18:00", window)
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		schedule.windows = append(schedule.windows, bandwidthWindow{start: start, end: end, rate: rate})
+	}
+	return schedule, nil
+}
+
+func parseRate(s string) (int64, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "off") {
+		return 0, nil
+	}
+	return util.ParseSize(s)
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected a time such as 08:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// RateAt returns the limit in bytes per second at t, 0 if it's unlimited.
+func (s *BandwidthSchedule) RateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start <= w.end && minute >= w.start && minute < w.end {
+			return w.rate
+		} else if w.start > w.end && (minute >= w.start || minute < w.end) {
+			return w.rate
+		}
+	}
+	return s.rate
+}
+
+// bandwidthBurst is the most bytes which are read at once while limited, keeping the
+// transfer smooth rather than stalling between large bursts.
+const bandwidthBurst = 32 * 1024
+
+// BandwidthLimiter is a token bucket shared by every transfer, limiting their combined
+// rate to what the schedule allows at the time.
+type BandwidthLimiter struct {
+	schedule *BandwidthSchedule
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter limits transfers to schedule.
+func NewBandwidthLimiter(schedule *BandwidthSchedule) *BandwidthLimiter {
+	return &BandwidthLimiter{schedule: schedule}
+}
+
+// wait blocks until n bytes may be transferred, or c is done.
+func (l *BandwidthLimiter) wait(c context.Context, n int) error {
+	l.mutex.Lock()
+	now := time.Now()
+	rate := l.schedule.RateAt(now)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mutex.Unlock()
+		return nil
+	}
+
+	// refill for the time since the last transfer, allowing at most a second's worth to
+	// build up, then reserve n bytes which may leave the bucket in debt
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// limitedReader reads from r no faster than its limiter allows.
+type limitedReader struct {
+	r       io.Reader
+	limiter *BandwidthLimiter
+	ctx     context.Context
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthBurst {
+		p = p[:bandwidthBurst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// limitedBytes is a limited reader of a request body, which knows its length so requests
+// still send a Content-Length.
+type limitedBytes struct {
+	limitedReader
+	b *bytes.Reader
+}
+
+func (r *limitedBytes) Len() int {
+	return r.b.Len()
+}
+
+// limitBody returns the body of a request, limited if ctx has a bandwidth limit. Bodies
+// other than byte slices are small enough not to matter.
+func limitBody(ctx *Context, rawBody interface{}) interface{} {
+	buf, ok := rawBody.([]byte)
+	if !ok || ctx.Bandwidth == nil {
+		return rawBody
+	}
+	return func() (io.Reader, error) {
+		b := bytes.NewReader(buf)
+		return &limitedBytes{limitedReader{r: b, limiter: ctx.Bandwidth, ctx: ctx.requestContext()}, b}, nil
+	}
+}
+
+// limitResponse returns the body of a response, limited if ctx has a bandwidth limit.
+func limitResponse(ctx *Context, body io.Reader) io.Reader {
+	if ctx.Bandwidth == nil {
+		return body
+	}
+	return &limitedReader{r: body, limiter: ctx.Bandwidth, ctx: ctx.requestContext()}
+}
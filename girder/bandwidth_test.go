@@ -0,0 +1,68 @@
+package girder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func Test_BandwidthSchedule(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	tests := []struct {
+		limit   string
+		clock   string
+		want    int64
+		wantErr bool
+	}{
+		{"20M", "12:00", 20 * 1024 * 1024, false},
+		{"off", "12:00", 0, false},
+		{"08:00-18:00=5M,off", "07:59", 0, false},
+		{"08:00-18:00=5M,off", "08:00", 5 * 1024 * 1024, false},
+		{"08:00-18:00=5M,off", "18:00", 0, false},
+		{"08:00-18:00=5M,20M", "20:00", 20 * 1024 * 1024, false},
+		{"22:00-06:00=off,1M", "23:30", 0, false},
+		{"22:00-06:00=off,1M", "05:59", 0, false},
+		{"22:00-06:00=off,1M", "12:00", 1024 * 1024, false},
+		{"8am-6pm=5M", "", 0, true},
+		{"08:00=5M", "", 0, true},
+		{"08:00-18:00=fast", "", 0, true},
+	}
+	for _, tt := range tests {
+		schedule, err := ParseBandwidthSchedule(tt.limit)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBandwidthSchedule(%q) err = %v, want error %v", tt.limit, err, tt.wantErr)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if got := schedule.RateAt(at(tt.clock)); got != tt.want {
+			t.Errorf("%q RateAt(%s) = %d, want %d", tt.limit, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func Test_BandwidthLimiter(t *testing.T) {
+	schedule, _ := ParseBandwidthSchedule("1M")
+	limiter := NewBandwidthLimiter(schedule)
+	r := &limitedReader{r: bytes.NewReader(make([]byte, 256*1024)), limiter: limiter, ctx: context.Background()}
+
+	start := time.Now()
+	if b, err := ioutil.ReadAll(r); err != nil || len(b) != 256*1024 {
+		t.Fatalf("ReadAll() = %d bytes, %v", len(b), err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("reading 256K at 1M/s took %s, want about 250ms", elapsed)
+	}
+
+	// waiting is abandoned once the transfer is cancelled
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(c, 1024*1024); err != context.Canceled {
+		t.Errorf("wait() after cancelling = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,86 @@
+package girder
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// ClientOptions configures the HTTP client shared by every request made to girder.
+type ClientOptions struct {
+	// Retries is how many times a failed request is retried, waiting at most
+	// RetryWaitMax between attempts.
+	Retries      int
+	RetryWaitMax time.Duration
+
+	// Timeout is how long to wait for girder to respond to a request, not including
+	// the time spent transferring the body.
+	Timeout time.Duration
+
+	// MaxConnsPerHost limits the number of open connections to girder, which
+	// are kept alive and reused by subsequent requests.
+	MaxConnsPerHost int
+}
+
+// DefaultClientOptions returns the options used when none are given.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		Retries:         4,
+		RetryWaitMax:    30 * time.Second,
+		Timeout:         60 * time.Second,
+		MaxConnsPerHost: 32,
+	}
+}
+
+// NewClient creates an HTTP client for making requests on behalf of ctx, logging
+// retries and, at the trace level, every request.
+func NewClient(ctx *Context, opts ClientOptions) *retryablehttp.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          opts.MaxConnsPerHost,
+		MaxIdleConnsPerHost:   opts.MaxConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: opts.Timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient = &http.Client{Transport: transport}
+	client.RetryMax = opts.Retries
+	client.RetryWaitMax = opts.RetryWaitMax
+	if client.RetryWaitMin > client.RetryWaitMax {
+		client.RetryWaitMin = client.RetryWaitMax
+	}
+	client.Logger = log.New(ioutil.Discard, "", 0)
+	client.RequestLogHook = func(_ retryablehttp.Logger, request *http.Request, tryNumber int) {
+		if tryNumber > 0 {
+			ctx.Logger.Warnf("retrying (attempt %d/%d): %s\n", tryNumber+1, opts.Retries+1, urlFromRequest(request))
+		} else {
+			ctx.Logger.Tracef("%s %s", request.Method, urlFromRequest(request))
+		}
+	}
+	client.ResponseLogHook = func(_ retryablehttp.Logger, response *http.Response) {
+		ctx.Logger.Tracef("%s %s: %s", response.Request.Method, urlFromRequest(response.Request), response.Status)
+	}
+	return client
+}
+
+// httpClient returns the client shared by requests made with ctx, or a new one if the
+// context wasn't given one.
+func httpClient(ctx *Context) *retryablehttp.Client {
+	if ctx.Client != nil {
+		return ctx.Client
+	}
+	return NewClient(ctx, DefaultClientOptions())
+}
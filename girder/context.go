@@ -1,28 +1,139 @@
 package girder
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/danlamanna/rivet/filter"
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/sirupsen/logrus"
 )
 
+// ProgressTracker follows how much of a sync has been transferred, so it can be displayed.
+type ProgressTracker interface {
+	Plan(size int64)
+	Start(path string, size int64, offset int64)
+	Add(path string, n int64)
+	End(path string)
+	Finish(resource *Resource)
+}
+
 // Context stores the entire context needed to run a sync command
 type Context struct {
+	// Auth is the credentials to authenticate with, replaced by a token once they're
+	// validated, and AuthType what kind of credentials they are, guessed if empty.
 	Auth        string
+	AuthType    string
 	URL         string
 	Logger      *logrus.Logger
 	Destination string
 	ResourceMap ResourceMap
+
+	// Client is shared by every request made to girder, so connections are reused.
+	Client *retryablehttp.Client
+
+	// Ctx is canceled when the sync is interrupted, aborting requests in flight.
+	Ctx context.Context
+
+	// RootType is the girder model type of the folder, collection, or user being synced
+	// to or from, a folder if empty.
+	RootType string
+
+	// Compare is the strategy used for deciding whether a file differs
+	// between local and remote, one of size, mtime, or checksum.
+	Compare string
+
+	// Delete removes files from the destination which don't exist in the source,
+	// as long as there are no more than MaxDelete of them (0 being unlimited).
+	Delete    bool
+	MaxDelete int
+
+	// DryRun prevents any changes from being made to the destination, only
+	// recording what would have been done.
+	DryRun bool
+
+	// Filter excludes paths from being synced, NumExcluded counts how many were.
+	Filter      *filter.Filter
+	NumExcluded int
+
+	// Symlinks is how symbolic links are handled, one of skip, follow, or preserve.
+	Symlinks string
+
+	// Unwalked are the local paths which were skipped while scanning, or whose contents
+	// couldn't be read, so they're left alone in the destination by Delete.
+	Unwalked map[string]bool
+
+	// FullRescan ignores what was recorded by previous syncs, checking every path
+	// against girder.
+	FullRescan bool
+
+	// ItemLayout is how items without exactly one file are synced, one of skip
+	// or directory.
+	ItemLayout string
+
+	// Metadata is how folder and item metadata is synced, one of none or sidecar.
+	Metadata string
+
+	// CreateDestination creates folders missing from the end of a girder destination path
+	CreateDestination bool
+
+	// Events receives a newline delimited JSON event for each step of the sync, if set.
+	Events *EventStream
+
+	// Progress is the terminal the progress of the sync is drawn on, if set.
+	Progress io.Writer
+
+	// Tracker follows how much of the sync has been transferred while its progress is
+	// being drawn, nil otherwise. It's set by the sync itself.
+	Tracker ProgressTracker
+
+	// Workers is how many items and files are synced at once, FolderWorkers how many
+	// folders are created at once, and ChunkParallelism how many chunks of a single file
+	// are uploaded at once. Defaults are used for any which are 0.
+	Workers          int
+	FolderWorkers    int
+	ChunkParallelism int
+
+	// ChunkSize is how many bytes of a file are uploaded per request, a default if 0.
+	ChunkSize int64
+
+	// ChunkOrder is whether girder accepts the chunks of an upload out of order, which is
+	// found out by the first upload whose chunks are sent in parallel. It's 0 until then,
+	// and read and written atomically.
+	ChunkOrder int32
+
+	// Bandwidth limits how fast files are uploaded and downloaded, if set.
+	Bandwidth *BandwidthLimiter
+
+	// OTP is the one-time password sent when logging in with a password, for users with
+	// two-factor authentication. PromptOTP asks for one if girder requires it and OTP is
+	// empty, if set.
+	OTP       string
+	PromptOTP func() (string, error)
+
+	// TokenCache keeps the token Auth is exchanged for between runs, if set.
+	TokenCache TokenCache
+
+	// credentials are what Auth was exchanged for, kept so the token can be replaced if it
+	// expires during a sync. authMutex guards them and Auth.
+	credentials     string
+	credentialsType string
+	authMutex       sync.Mutex
 }
 
-func GetValidURL(maybeInvalidURL string) (string, error) {
+// GetValidURL finds the girder API at maybeInvalidURL, making requests with the client
+// and logger of ctx.
+func GetValidURL(ctx *Context, maybeInvalidURL string) (string, error) {
 	tempCtx := new(Context)
 	tempCtx.URL = maybeInvalidURL
-	tempCtx.Logger = logrus.New()
+	tempCtx.Logger = ctx.Logger
+	tempCtx.Client = ctx.Client
 
 	u, err := url.Parse(maybeInvalidURL)
 	if err != nil {
@@ -85,50 +196,24 @@ func (c *Context) CheckMinimumVersion() error {
 	return nil
 }
 
-func (c *Context) ValidateAuth() error {
-	if strings.Index(c.Auth, ":") != -1 {
-		// try username/password
-		token := new(GirderTokenResponse)
-		httpErr := new(GirderError)
-		resp, err := GetBasicAuth(c, c.Auth, "user/authentication", token, httpErr)
-		if err != nil {
-			return err
-		} else if resp.StatusCode != 200 {
-			return httpErr
-		}
-		c.Auth = token.AuthToken.Token
-		c.Logger.Debugf("authenticated with username/password (user %s)", token.User.Email)
-		return nil
-	} else if len(c.Auth) == 40 {
-		// try api key
-		token := new(GirderTokenResponse)
-		httpErr := new(GirderError)
-		resp, err := Post(c, fmt.Sprintf("api_key/token?key=%s", c.Auth), nil, token, httpErr)
-		if err != nil {
-			return err
-		} else if resp.StatusCode != 200 {
-			return httpErr
-		}
-		c.Auth = token.AuthToken.Token
-		c.Logger.Debugf("authenticated with api key (user %s)", token.User.ID)
-		return nil
-	} else if len(c.Auth) == 64 {
-		// try token
-		user := new(GirderUser)
-		httpErr := new(GirderError)
-		resp, err := Get(c, "user/me", user, httpErr)
-		if err != nil {
-			return err
-		} else if resp.StatusCode != 200 {
-			return httpErr
-		} else if user.Email == "" {
-			// account for the "null user"
-			return errors.New("failed to authenticate")
+// RootParentType returns the girder model type of the root of the sync, for use as a
+// parentType parameter.
+func (c *Context) RootParentType() string {
+	if c.RootType == "" {
+		return "folder"
+	}
+	return c.RootType
+}
 
-		}
-		c.Logger.Debugf("authenticated as %s", user.Email)
-		return nil
-	} else {
-		return errors.New("Unable to validate credentials, have they expired?")
+// Interrupted reports whether the sync has been interrupted, in which case no new work
+// should be started.
+func (c *Context) Interrupted() bool {
+	return c.Ctx != nil && c.Ctx.Err() != nil
+}
+
+func (c *Context) requestContext() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
 	}
+	return c.Ctx
 }
@@ -0,0 +1,40 @@
+package girder
+
+import (
+	"io"
+	"sync"
+)
+
+// EventStream is where the events of a sync are written, one per line. It's shared by
+// concurrent workers, so writes are serialized.
+type EventStream struct {
+	w        io.Writer
+	mutex    sync.Mutex
+	reported map[string]bool
+}
+
+// NewEventStream returns a stream writing events to w.
+func NewEventStream(w io.Writer) *EventStream {
+	return &EventStream{w: w, reported: make(map[string]bool)}
+}
+
+// WriteLine writes line followed by a newline, without interleaving it with lines
+// written concurrently.
+func (s *EventStream) WriteLine(line []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Report records that the outcome of path has been written, returning false if it
+// already had been so each outcome is only written once.
+func (s *EventStream) Report(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reported[path] {
+		return false
+	}
+	s.reported[path] = true
+	return true
+}
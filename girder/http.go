@@ -3,23 +3,55 @@ package girder
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"time"
-
-	"io/ioutil"
-	"log"
+	"strings"
 
 	"github.com/danlamanna/rivet/version"
 	"github.com/hashicorp/go-retryablehttp"
-	"github.com/sirupsen/logrus"
 )
 
+// ErrRangeIgnored is returned when a partial download was requested but the server responded
+// with the entire body.
+var ErrRangeIgnored = errors.New("server does not support range requests")
+
 func addBaseHeaders(ctx *Context, request *retryablehttp.Request) {
 	request.Header.Add("User-Agent", fmt.Sprintf("rivet/%s", version.Version))
-	request.Header.Add("Girder-Token", ctx.Auth)
+	request.Header.Add("Girder-Token", ctx.token())
+}
+
+// do sends request, and if girder rejects the token it was sent with, authenticates
+// again and sends it once more. Long syncs may outlive their token.
+func do(ctx *Context, request *retryablehttp.Request) (*http.Response, error) {
+	response, err := httpClient(ctx).Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	stale := request.Header.Get("Girder-Token")
+	if stale == "" {
+		return response, nil
+	}
+	if replaced, err := ctx.reauthenticate(stale); err != nil {
+		ctx.Logger.Warn(err)
+		return response, nil
+	} else if !replaced {
+		return response, nil
+	}
+
+	response.Body.Close()
+	request.Header.Set("Girder-Token", ctx.token())
+	return httpClient(ctx).Do(request)
+}
+
+// newRequest creates a request which is aborted if the sync is interrupted.
+func newRequest(ctx *Context, method string, url string, rawBody interface{}) (*retryablehttp.Request, error) {
+	request, err := retryablehttp.NewRequest(method, url, limitBody(ctx, rawBody))
+	if err != nil {
+		return nil, err
+	}
+	return request.WithContext(ctx.requestContext()), nil
 }
 
 func urlFromRequest(request *http.Request) string {
@@ -34,14 +66,6 @@ func urlFromRequest(request *http.Request) string {
 
 }
 
-func logRequest(ctx *Context) func(retryablehttp.Logger, *http.Request, int) {
-	return func(logger retryablehttp.Logger, request *http.Request, tryNumber int) {
-		if tryNumber > 0 {
-			ctx.Logger.Warnf("retrying (attempt %d/5): %s\n", tryNumber+1, urlFromRequest(request))
-		}
-	}
-}
-
 func decodeResponse(resp *http.Response, success, failure interface{}) error {
 	if code := resp.StatusCode; 200 <= code && code <= 299 {
 		return json.NewDecoder(resp.Body).Decode(success)
@@ -51,12 +75,7 @@ func decodeResponse(resp *http.Response, success, failure interface{}) error {
 
 // Get does stuff
 func Get(ctx *Context, url string, success interface{}, failure interface{}) (*http.Response, error) {
-	client := retryablehttp.NewClient()
-	if ctx.Logger.Level <= logrus.TraceLevel {
-		client.Logger = log.New(ioutil.Discard, "", 0)
-		client.RequestLogHook = logRequest(ctx)
-	}
-	request, err := retryablehttp.NewRequest("GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
+	request, err := newRequest(ctx, "GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
 
 	if err != nil {
 		return nil, err
@@ -64,7 +83,7 @@ func Get(ctx *Context, url string, success interface{}, failure interface{}) (*h
 
 	addBaseHeaders(ctx, request)
 
-	response, err := client.Do(request)
+	response, err := do(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -77,12 +96,7 @@ func Get(ctx *Context, url string, success interface{}, failure interface{}) (*h
 
 // GetBasicAuth does stuff
 func GetBasicAuth(ctx *Context, auth string, url string, success interface{}, failure interface{}) (*http.Response, error) {
-	client := retryablehttp.NewClient()
-	if ctx.Logger.Level <= logrus.TraceLevel {
-		client.Logger = log.New(ioutil.Discard, "", 0)
-		client.RequestLogHook = logRequest(ctx)
-	}
-	request, err := retryablehttp.NewRequest("GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
+	request, err := newRequest(ctx, "GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
 
 	if err != nil {
 		return nil, err
@@ -91,8 +105,11 @@ func GetBasicAuth(ctx *Context, auth string, url string, success interface{}, fa
 	request.Header.Add("User-Agent", fmt.Sprintf("rivet/%s", version.Version))
 	authHeader := base64.StdEncoding.EncodeToString([]byte(auth))
 	request.Header.Add("Authorization", fmt.Sprintf("Basic %s", authHeader))
+	if ctx.OTP != "" {
+		request.Header.Add("Girder-OTP", ctx.OTP)
+	}
 
-	response, err := client.Do(request)
+	response, err := httpClient(ctx).Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -102,26 +119,38 @@ func GetBasicAuth(ctx *Context, auth string, url string, success interface{}, fa
 
 	return response, nil
 }
-func GetDownload(ctx *Context, url string, file *os.File) (*http.Response, error) {
-	client := retryablehttp.NewClient()
-	if ctx.Logger.Level <= logrus.TraceLevel {
-		client.Logger = log.New(ioutil.Discard, "", 0)
-		client.RequestLogHook = logRequest(ctx)
-	}
-	request, err := retryablehttp.NewRequest("GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
+
+// GetDownload copies the body of url into file. When offset is non-zero only the bytes from
+// offset onward are requested, and ErrRangeIgnored is returned if the server sends everything.
+func GetDownload(ctx *Context, url string, offset int64, file io.Writer) (*http.Response, error) {
+	request, err := newRequest(ctx, "GET", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
 
 	if err != nil {
 		return nil, err
 	}
 
 	addBaseHeaders(ctx, request)
+	if offset > 0 {
+		request.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
-	response, err := client.Do(request)
+	response, err := do(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
-	_, err = io.Copy(file, response.Body)
+
+	if code := response.StatusCode; code < 200 || code > 299 {
+		httpErr := new(GirderError)
+		if json.NewDecoder(response.Body).Decode(httpErr) != nil || httpErr.Message == "" {
+			httpErr.Message = fmt.Sprintf("unexpected status %s", response.Status)
+		}
+		return response, httpErr
+	} else if offset > 0 && response.StatusCode != http.StatusPartialContent {
+		return response, ErrRangeIgnored
+	}
+
+	_, err = io.Copy(file, limitResponse(ctx, response.Body))
 	if err != nil {
 		return response, err
 	}
@@ -131,13 +160,7 @@ func GetDownload(ctx *Context, url string, file *os.File) (*http.Response, error
 
 // Post does stuff
 func Post(ctx *Context, url string, rawBody interface{}, success interface{}, failure *GirderError) (*http.Response, error) {
-	client := retryablehttp.NewClient()
-	client.RetryWaitMax = time.Millisecond * 100
-	if ctx.Logger.Level != logrus.TraceLevel {
-		client.Logger = log.New(ioutil.Discard, "", 0)
-		client.RequestLogHook = logRequest(ctx)
-	}
-	request, err := retryablehttp.NewRequest("POST", fmt.Sprintf("%s/%s", ctx.URL, url), rawBody)
+	request, err := newRequest(ctx, "POST", fmt.Sprintf("%s/%s", ctx.URL, url), rawBody)
 
 	if err != nil {
 		return nil, err
@@ -145,28 +168,29 @@ func Post(ctx *Context, url string, rawBody interface{}, success interface{}, fa
 
 	addBaseHeaders(ctx, request)
 
-	response, err := client.Do(request)
+	response, err := do(ctx, request)
 
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 	decodeResponse(response, success, failure)
-	if response.StatusCode != 200 && failure != nil {
+	if response.StatusCode != 200 && failure != nil && !IsChunkOutOfOrder(failure) {
 		ctx.Logger.Warn(failure.Message)
 	}
 
 	return response, nil
 }
 
+// IsChunkOutOfOrder reports whether girder refused a chunk of an upload because it hasn't
+// received all of the chunks before it, which is expected when sending chunks in parallel.
+func IsChunkOutOfOrder(failure *GirderError) bool {
+	return strings.HasPrefix(failure.Message, "Server has received")
+}
+
 // Put does stuff
 func Put(ctx *Context, url string, rawBody interface{}, success interface{}, failure interface{}) (*http.Response, error) {
-	client := retryablehttp.NewClient()
-	if ctx.Logger.Level <= logrus.TraceLevel {
-		client.Logger = log.New(ioutil.Discard, "", 0)
-		client.RequestLogHook = logRequest(ctx)
-	}
-	request, err := retryablehttp.NewRequest("PUT", fmt.Sprintf("%s/%s", ctx.URL, url), rawBody)
+	request, err := newRequest(ctx, "PUT", fmt.Sprintf("%s/%s", ctx.URL, url), rawBody)
 
 	if err != nil {
 		return nil, err
@@ -174,11 +198,31 @@ func Put(ctx *Context, url string, rawBody interface{}, success interface{}, fai
 
 	addBaseHeaders(ctx, request)
 
-	response, err := client.Do(request)
+	response, err := do(ctx, request)
+	if err != nil {
+		return nil, err
+	}
 	defer response.Body.Close()
+
+	decodeResponse(response, success, failure)
+	return response, nil
+}
+
+// Delete does stuff
+func Delete(ctx *Context, url string, success interface{}, failure interface{}) (*http.Response, error) {
+	request, err := newRequest(ctx, "DELETE", fmt.Sprintf("%s/%s", ctx.URL, url), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addBaseHeaders(ctx, request)
+
+	response, err := do(ctx, request)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
 
 	decodeResponse(response, success, failure)
 	return response, nil
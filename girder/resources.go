@@ -1,15 +1,47 @@
 package girder
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
 )
 
-func GetOrCreateFolderRecursive(ctx *Context, path string) (GirderID, error) {
-	parentID := GirderID(ctx.Destination)
+// createdWithin is how long before girder responded an object returned by a request made
+// with reuseExisting may have been created for that request to have created it.
+const createdWithin = 5 * time.Second
+
+// wasCreated reports whether obj, returned by a request made with reuseExisting, was
+// created by that request rather than already existing. Girder doesn't say which, so
+// obj is new if it was created just before girder responded.
+func wasCreated(response *http.Response, obj *GirderObject) bool {
+	created, err := ParseTime(obj.Created)
+	if err != nil {
+		return false
+	}
+	responded, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return false
+	}
+	return !created.Before(responded.Add(-createdWithin))
+}
+
+// GetOrCreateFolderRecursive returns the ID of the folder at path within the destination,
+// creating it and any of its parents which don't exist, and whether the folder itself was
+// created. During a dry run nothing is created.
+func GetOrCreateFolderRecursive(ctx *Context, path string) (GirderID, bool, error) {
+	if ctx.DryRun {
+		id, err := resolveFolderRecursive(ctx, path)
+		return id, false, err
+	}
+
+	parentID, parentType := GirderID(ctx.Destination), ctx.RootParentType()
 	parts := strings.Split(path, "/")
+	created := false
 
 	for i, part := range parts {
 		partialPath := strings.Join(parts[0:i+1], "/")
@@ -17,7 +49,7 @@ func GetOrCreateFolderRecursive(ctx *Context, path string) (GirderID, error) {
 		// check map if this dir has already been made (parents)
 		if val, ok := ctx.ResourceMap[partialPath]; ok {
 			if !val.SkipSync && val.GirderID != "" {
-				parentID = val.GirderID
+				parentID, parentType, created = val.GirderID, "folder", false
 				continue
 			} else if val.SkipSync {
 				// skip this folder for the same reason its parent was skipped
@@ -25,74 +57,172 @@ func GetOrCreateFolderRecursive(ctx *Context, path string) (GirderID, error) {
 				ctx.ResourceMap[path].SkipSync = true
 				ctx.ResourceMap[path].SkipReason = ctx.ResourceMap[partialPath].SkipReason
 				ctx.Logger.Warnf("skipping creation of %s since parent failed", path)
-				return "", errors.New("parent")
+				return "", false, errors.New("parent")
 			}
 		}
 
 		folder := new(GirderObject)
 		httpErr := new(GirderError)
-		url := fmt.Sprintf("folder?parentType=folder&reuseExisting=true&name=%s&parentId=%s", url.QueryEscape(part), string(parentID))
-		_, err := Post(ctx, url, nil, folder, httpErr)
+		url := fmt.Sprintf("folder?parentType=%s&reuseExisting=true&name=%s&parentId=%s", parentType, url.QueryEscape(part), string(parentID))
+		response, err := Post(ctx, url, nil, folder, httpErr)
 		if err != nil {
 			ctx.Logger.Errorf("problem creating %s, err: %s", partialPath, err)
 			ctx.ResourceMap[path].GirderType = "folder"
 			ctx.ResourceMap[path].SkipSync = true
 			ctx.ResourceMap[path].SkipReason = err.Error()
-			return "", err
+			return "", false, err
 		} else if httpErr.Message != "" {
 			ctx.Logger.Errorf("problem creating %s, err: %s", partialPath, httpErr.Message)
 			ctx.ResourceMap[path].GirderType = "folder"
 			ctx.ResourceMap[path].SkipSync = true
 			ctx.ResourceMap[path].SkipReason = httpErr.Error()
-			return "", httpErr
+			return "", false, httpErr
 		}
-		parentID = folder.ID
+		parentID, parentType, created = folder.ID, "folder", wasCreated(response, folder)
 		ctx.ResourceMap[path].GirderType = "folder"
 		ctx.ResourceMap[path].GirderID = folder.ID
 	}
 
+	return parentID, created, nil
+}
+
+// resolveFolderRecursive is the read-only counterpart of GetOrCreateFolderRecursive used
+// for dry runs. It finds the ID of path if it already exists, otherwise recording that
+// the folder would be created.
+func resolveFolderRecursive(ctx *Context, path string) (GirderID, error) {
+	parentID, parentType := GirderID(ctx.Destination), ctx.RootParentType()
+	parts := strings.Split(path, "/")
+
+	for i, part := range parts {
+		partialPath := strings.Join(parts[0:i+1], "/")
+		if parentID == "" {
+			// the destination would have been created, so nothing within it exists
+			break
+		}
+
+		// parents have already been resolved, and if they don't exist neither can this
+		if val, ok := ctx.ResourceMap[partialPath]; ok && partialPath != path && val.GirderType == "folder" {
+			if val.SkipSync {
+				ctx.ResourceMap[path].GirderType = "folder"
+				ctx.ResourceMap[path].SkipSync = true
+				ctx.ResourceMap[path].SkipReason = val.SkipReason
+				return "", errors.New("parent")
+			}
+			parentID, parentType = val.GirderID, "folder"
+			if parentID == "" {
+				break
+			}
+			continue
+		}
+
+		folderID, err := FindFolder(ctx, parentType, parentID, part)
+		if err != nil {
+			ctx.Logger.Errorf("problem finding %s, err: %s", partialPath, err)
+			ctx.ResourceMap[path].GirderType = "folder"
+			ctx.ResourceMap[path].SkipSync = true
+			ctx.ResourceMap[path].SkipReason = err.Error()
+			return "", err
+		}
+		parentID, parentType = folderID, "folder"
+		if parentID == "" {
+			break
+		}
+	}
+
+	ctx.ResourceMap[path].GirderType = "folder"
+	ctx.ResourceMap[path].GirderID = parentID
+	if parentID == "" {
+		ctx.ResourceMap[path].Action = "create folder"
+	} else {
+		ctx.ResourceMap[path].Action = "skip"
+		ctx.ResourceMap[path].ActionReason = "folder exists"
+	}
 	return parentID, nil
 }
 
-func GetOrCreateItem(ctx *Context, folderID GirderID, name string) (GirderID, error) {
+// FindFolder returns the ID of the folder named name within parentID, a folder,
+// collection, or user depending on parentType, or an empty ID if there is no such folder.
+func FindFolder(ctx *Context, parentType string, parentID GirderID, name string) (GirderID, error) {
+	folders := make([]GirderObject, 0)
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("folder?parentType=%s&parentId=%s&name=%s", parentType, parentID, url.QueryEscape(name)), &folders, httpErr)
+	if err != nil {
+		return "", err
+	} else if httpErr.Message != "" {
+		return "", httpErr
+	} else if len(folders) == 0 {
+		return "", nil
+	}
+	return folders[0].ID, nil
+}
+
+// FindItem returns the ID of the item named name within folderID, or an empty
+// ID if there is no such item.
+func FindItem(ctx *Context, folderID GirderID, name string) (GirderID, error) {
+	items := make([]GirderObject, 0)
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("item?folderId=%s&name=%s", folderID, url.QueryEscape(name)), &items, httpErr)
+	if err != nil {
+		return "", err
+	} else if httpErr.Message != "" {
+		return "", httpErr
+	} else if len(items) == 0 {
+		return "", nil
+	}
+	return items[0].ID, nil
+}
+
+// GetOrCreateItem returns the ID of the item named name within folderID, creating it if
+// it doesn't exist, and whether it was created. During a dry run nothing is created.
+func GetOrCreateItem(ctx *Context, folderID GirderID, name string) (GirderID, bool, error) {
+	if ctx.DryRun {
+		// the folder would have been created, so the item can't exist yet
+		if folderID == "" {
+			return "", false, nil
+		}
+		id, err := FindItem(ctx, folderID, name)
+		return id, false, err
+	}
+
 	obj := new(GirderObject)
 	httpErr := new(GirderError)
-	_, err := Post(ctx, fmt.Sprintf("item?folderId=%s&name=%s&reuseExisting=true", folderID, url.QueryEscape(name)), nil, obj, httpErr)
+	response, err := Post(ctx, fmt.Sprintf("item?folderId=%s&name=%s&reuseExisting=true", folderID, url.QueryEscape(name)), nil, obj, httpErr)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("failed to create item %s, err: %s", name, err))
+		return "", false, errors.New(fmt.Sprintf("failed to create item %s, err: %s", name, err))
 	} else if httpErr.Message != "" {
-		return "", errors.New(fmt.Sprintf("failed to create item %s, err: %s", name, httpErr.Message))
+		return "", false, errors.New(fmt.Sprintf("failed to create item %s, err: %s", name, httpErr.Message))
 	}
-	return obj.ID, nil
+	return obj.ID, wasCreated(response, obj), nil
 }
 
-func ItemFiles(ctx *Context, itemID GirderID) []GirderFile {
-	files := new([]GirderFile)
+// ItemFiles lists the files of the item itemID.
+func ItemFiles(ctx *Context, itemID GirderID) ([]GirderFile, error) {
+	files := make([]GirderFile, 0)
 	httpErr := new(GirderError)
-	_, err := Get(ctx, fmt.Sprintf("item/%s/files", itemID), files, httpErr)
+	_, err := Get(ctx, fmt.Sprintf("item/%s/files", itemID), &files, httpErr)
 	if err != nil {
-		return nil
+		return nil, err
 	} else if httpErr.Message != "" {
-		fmt.Printf(httpErr.Message)
-		return nil
+		return nil, httpErr
 	}
-	return *files
+	return files, nil
 }
 
-func Folders(ctx *Context, folderID GirderID) []GirderObject {
+// Folders lists the folders within parentID, a folder, collection, or user depending on
+// parentType.
+func Folders(ctx *Context, parentType string, parentID GirderID) ([]GirderObject, error) {
 	folders := make([]GirderObject, 0)
 	httpErr := new(GirderError)
 	offset := 0
 	limit := 50
 	for {
 		pageFolders := make([]GirderObject, 0)
-		_, err := Get(ctx, fmt.Sprintf("folder?parentType=folder&parentId=%s&offset=%d&limit=%d", folderID, offset, limit), &pageFolders, httpErr)
+		_, err := Get(ctx, fmt.Sprintf("folder?parentType=%s&parentId=%s&offset=%d&limit=%d", parentType, parentID, offset, limit), &pageFolders, httpErr)
 
 		if err != nil {
-			return nil
+			return nil, err
 		} else if httpErr.Message != "" {
-			fmt.Printf(httpErr.Message)
-			return nil
+			return nil, httpErr
 		}
 
 		if len(pageFolders) == 0 {
@@ -102,22 +232,27 @@ func Folders(ctx *Context, folderID GirderID) []GirderObject {
 		}
 		offset += limit
 	}
-	return folders
+	return folders, nil
 }
-func Items(ctx *Context, folderID GirderID) []GirderObject {
+
+// Items lists the items within parentID, which is always empty for collections and
+// users since only folders can contain items.
+func Items(ctx *Context, parentType string, parentID GirderID) ([]GirderObject, error) {
 	items := make([]GirderObject, 0)
+	if parentType != "folder" {
+		return items, nil
+	}
 	httpErr := new(GirderError)
 	offset := 0
 	limit := 50
 	for {
 		pageItems := make([]GirderObject, 0)
-		_, err := Get(ctx, fmt.Sprintf("item?folderId=%s&offset=%d&limit=%d", folderID, offset, limit), &pageItems, httpErr)
+		_, err := Get(ctx, fmt.Sprintf("item?folderId=%s&offset=%d&limit=%d", parentID, offset, limit), &pageItems, httpErr)
 
 		if err != nil {
-			return nil
+			return nil, err
 		} else if httpErr.Message != "" {
-			fmt.Printf(httpErr.Message)
-			return nil
+			return nil, httpErr
 		}
 
 		if len(pageItems) == 0 {
@@ -127,5 +262,175 @@ func Items(ctx *Context, folderID GirderID) []GirderObject {
 		}
 		offset += limit
 	}
-	return items
+	return items, nil
+}
+
+// DeleteResource deletes a folder or item, along with everything it contains.
+func DeleteResource(ctx *Context, girderType string, id GirderID) error {
+	httpErr := new(GirderError)
+	_, err := Delete(ctx, fmt.Sprintf("%s/%s", girderType, id), nil, httpErr)
+	if err != nil {
+		return err
+	} else if httpErr.Message != "" {
+		return httpErr
+	}
+	return nil
+}
+
+func GetItem(ctx *Context, itemID GirderID) (*GirderObject, error) {
+	item := new(GirderObject)
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("item/%s", itemID), item, httpErr)
+	if err != nil {
+		return nil, err
+	} else if httpErr.Message != "" {
+		return nil, httpErr
+	}
+	return item, nil
+}
+
+func GetFolder(ctx *Context, folderID GirderID) (*GirderObject, error) {
+	folder := new(GirderObject)
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("folder/%s", folderID), folder, httpErr)
+	if err != nil {
+		return nil, err
+	} else if httpErr.Message != "" {
+		return nil, httpErr
+	}
+	return folder, nil
+}
+
+// SetMetadata adds or replaces the given metadata keys of a folder or item. Keys with
+// nil values are removed.
+func SetMetadata(ctx *Context, girderType string, id GirderID, meta map[string]interface{}) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	httpErr := new(GirderError)
+	_, err = Put(ctx, fmt.Sprintf("%s/%s/metadata?allowNull=true", girderType, id), body, nil, httpErr)
+	if err != nil {
+		return err
+	} else if httpErr.Message != "" {
+		return httpErr
+	}
+	return nil
+}
+
+// UploadOffset returns the number of bytes girder has received for an in progress upload.
+func UploadOffset(ctx *Context, uploadID GirderID) (int64, error) {
+	offset := new(struct {
+		Offset int64 `json:"offset"`
+	})
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("file/offset?uploadId=%s", uploadID), offset, httpErr)
+	if err != nil {
+		return 0, err
+	} else if httpErr.Message != "" {
+		return 0, httpErr
+	}
+	return offset.Offset, nil
+}
+
+var objectIDPattern = regexp.MustCompile("^[0-9a-fA-F]{24}$")
+
+// LookupPath finds the resource at a girder path such as collection/<name>/<path>, returning
+// nil if nothing exists there.
+func LookupPath(ctx *Context, path string) (*GirderObject, error) {
+	obj := new(GirderObject)
+	httpErr := new(GirderError)
+	_, err := Get(ctx, fmt.Sprintf("resource/lookup?test=true&path=%s", url.QueryEscape("/"+path)), obj, httpErr)
+	if err != nil {
+		return nil, err
+	} else if strings.HasPrefix(httpErr.Message, "Path not found") {
+		return nil, nil
+	} else if httpErr.Message != "" {
+		return nil, httpErr
+	} else if obj.ID == "" {
+		return nil, nil
+	}
+	return obj, nil
+}
+
+// ResolveLocation turns the part of a girder:// URL after the scheme into the ID and model
+// type of a folder, collection, or user. It may be a folder ID, or a path such as
+// collection/<name>/<path> or user/<login>/<Public|Private>/<path>, where collection/<name>
+// and user/<login> refer to the root of the collection or user. If create is true, folders
+// missing from the end of the path are created.
+func ResolveLocation(ctx *Context, ref string, create bool) (GirderID, string, error) {
+	ref = strings.Trim(strings.TrimPrefix(ref, "girder://"), "/")
+	if objectIDPattern.MatchString(ref) {
+		return GirderID(ref), "folder", nil
+	}
+	obj, existing, missing, err := locatePath(ctx, ref)
+	if err != nil {
+		return "", "", err
+	} else if len(missing) > 0 && !create {
+		return "", "", fmt.Errorf("%s does not exist", ref)
+	}
+
+	parentID, parentType := obj.ID, obj.ModelType
+	for i, name := range missing {
+		created := strings.Join(append([]string{existing}, missing[:i+1]...), "/")
+		folder := new(GirderObject)
+		httpErr := new(GirderError)
+		_, err := Post(ctx, fmt.Sprintf("folder?parentType=%s&reuseExisting=true&name=%s&parentId=%s", parentType, url.QueryEscape(name), parentID), nil, folder, httpErr)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to create %s, err: %s", created, err)
+		} else if httpErr.Message != "" {
+			return "", "", fmt.Errorf("failed to create %s, err: %s", created, httpErr.Message)
+		}
+		ctx.Logger.Infof("created folder %s", created)
+		parentID, parentType = folder.ID, "folder"
+	}
+
+	if parentType != "folder" && parentType != "collection" && parentType != "user" {
+		return "", "", fmt.Errorf("%s is a %s, not a folder, collection, or user", ref, parentType)
+	}
+	return parentID, parentType, nil
+}
+
+// PlanLocation is the read-only counterpart of ResolveLocation with create set, used for
+// dry runs. If the location doesn't exist, an empty ID is returned along with the paths of
+// the folders which would be created, in the order they'd be created.
+func PlanLocation(ctx *Context, ref string) (GirderID, string, []string, error) {
+	ref = strings.Trim(strings.TrimPrefix(ref, "girder://"), "/")
+	if objectIDPattern.MatchString(ref) {
+		return GirderID(ref), "folder", nil, nil
+	}
+	obj, existing, missing, err := locatePath(ctx, ref)
+	if err != nil {
+		return "", "", nil, err
+	} else if obj.ModelType != "folder" && obj.ModelType != "collection" && obj.ModelType != "user" {
+		return "", "", nil, fmt.Errorf("%s is a %s, not a folder, collection, or user", existing, obj.ModelType)
+	} else if len(missing) == 0 {
+		return obj.ID, obj.ModelType, nil, nil
+	}
+
+	planned := make([]string, len(missing))
+	for i := range missing {
+		planned[i] = strings.Join(append([]string{existing}, missing[:i+1]...), "/")
+	}
+	return "", "folder", planned, nil
+}
+
+// locatePath finds the deepest part of a location path, such as collection/<name>/<path>,
+// which exists in girder, returning it along with its path and the names of the folders
+// missing from the end of ref.
+func locatePath(ctx *Context, ref string) (*GirderObject, string, []string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 || (parts[0] != "collection" && parts[0] != "user") {
+		return nil, "", nil, fmt.Errorf("invalid girder location %s, expected a folder ID, collection/<name>/<path>, or user/<login>/<path>", ref)
+	}
+
+	for existing := len(parts); existing >= 2; existing-- {
+		obj, err := LookupPath(ctx, strings.Join(parts[:existing], "/"))
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to look up %s, err: %s", strings.Join(parts[:existing], "/"), err)
+		} else if obj != nil {
+			return obj, strings.Join(parts[:existing], "/"), parts[existing:], nil
+		}
+	}
+	return nil, "", nil, fmt.Errorf("%s does not exist", strings.Join(parts[:2], "/"))
 }
@@ -0,0 +1,134 @@
+package girder
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// locationServer looks up the paths in existing, mapping them to their model type, and
+// creates any folder it's asked to, recording the name of each.
+type locationServer struct {
+	sync.Mutex
+	existing map[string]string
+	created  []string
+}
+
+func (s *locationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Method == "POST" && r.URL.Path == "/folder" {
+		name := r.URL.Query().Get("name")
+		s.created = append(s.created, name)
+		fmt.Fprintf(w, `{"_id": "%s", "_modelType": "folder"}`, name)
+	} else if modelType, ok := s.existing[r.URL.Query().Get("path")]; ok && r.URL.Path == "/resource/lookup" {
+		fmt.Fprintf(w, `{"_id": "%s", "_modelType": "%s"}`, modelType+"ID", modelType)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"message": "Path not found: %s"}`, r.URL.Query().Get("path"))
+	}
+}
+
+func TestResolveLocation(t *testing.T) {
+	tests := []struct {
+		ref      string
+		create   bool
+		wantID   GirderID
+		wantType string
+		created  []string
+		wantErr  string
+	}{
+		{"5e8f8a2b1b8a4c0001a1b2c3", false, "5e8f8a2b1b8a4c0001a1b2c3", "folder", nil, ""},
+		{"girder://collection/c", false, "collectionID", "collection", nil, ""},
+		{"girder://collection/c/f/", false, "folderID", "folder", nil, ""},
+		{"/user/u/Public/", false, "folderID", "folder", nil, ""},
+		{"girder://collection/c/f/new/newer", false, "", "", nil, "collection/c/f/new/newer does not exist"},
+		{"girder://collection/c/f/new/newer", true, "newer", "folder", []string{"new", "newer"}, ""},
+		{"girder://collection/c/f/i", false, "", "", nil, "collection/c/f/i is a item, not a folder, collection, or user"},
+		{"girder://collection/missing/f", true, "", "", nil, "collection/missing does not exist"},
+		{"girder://folder/f", false, "", "", nil, "invalid girder location folder/f"},
+		{"girder://collection", false, "", "", nil, "invalid girder location collection"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			s := &locationServer{existing: map[string]string{
+				"/collection/c":     "collection",
+				"/collection/c/f":   "folder",
+				"/collection/c/f/i": "item",
+				"/user/u/Public":    "folder",
+			}}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			id, modelType, err := ResolveLocation(locationContext(server.URL), tt.ref, tt.create)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("ResolveLocation() err = %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil || id != tt.wantID || modelType != tt.wantType {
+				t.Errorf("ResolveLocation() = %s, %s, %v, want %s, %s", id, modelType, err, tt.wantID, tt.wantType)
+			}
+			if strings.Join(s.created, "/") != strings.Join(tt.created, "/") {
+				t.Errorf("ResolveLocation() created %v, want %v", s.created, tt.created)
+			}
+		})
+	}
+}
+
+func TestPlanLocation(t *testing.T) {
+	s := &locationServer{existing: map[string]string{"/collection/c": "collection", "/collection/c/f": "folder"}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	ctx := locationContext(server.URL)
+
+	id, modelType, missing, err := PlanLocation(ctx, "girder://collection/c/f/new/newer")
+	want := []string{"collection/c/f/new", "collection/c/f/new/newer"}
+	if err != nil || id != "" || modelType != "folder" || strings.Join(missing, ",") != strings.Join(want, ",") {
+		t.Errorf("PlanLocation() = %q, %s, %v, %v, want the folders which would be created, %v", id, modelType, missing, err, want)
+	}
+	if len(s.created) > 0 {
+		t.Errorf("PlanLocation() created %v", s.created)
+	}
+
+	id, modelType, missing, err = PlanLocation(ctx, "girder://collection/c/f")
+	if err != nil || id != "folderID" || modelType != "folder" || len(missing) != 0 {
+		t.Errorf("PlanLocation() of an existing folder = %q, %s, %v, %v", id, modelType, missing, err)
+	}
+}
+
+func locationContext(url string) *Context {
+	return &Context{URL: url, Logger: logrus.New()}
+}
+
+func TestGetOrCreateItem(t *testing.T) {
+	tests := []struct {
+		name        string
+		created     string
+		wantCreated bool
+	}{
+		{"new item", time.Now().UTC().Format("2006-01-02T15:04:05.000000"), true},
+		{"existing item", "2020-01-02T03:04:05.000000+00:00", false},
+		{"unknown creation time", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"_id": "item", "_modelType": "item", "created": "%s"}`, tt.created)
+			}))
+			defer server.Close()
+			ctx := locationContext(server.URL)
+			ctx.Client = NewClient(ctx, ClientOptions{Retries: 0})
+
+			id, created, err := GetOrCreateItem(ctx, "folder", "i")
+			if err != nil || id != "item" || created != tt.wantCreated {
+				t.Errorf("GetOrCreateItem() = %s, %t, %v, want item, %t", id, created, err, tt.wantCreated)
+			}
+		})
+	}
+}
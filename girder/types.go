@@ -3,18 +3,25 @@ package girder
 import (
 	"path"
 	"sync"
+	"time"
 )
 
 type GirderID string
 
 type GirderObject struct {
-	ID   GirderID `json:"_id"`
-	Name string   `json:"name"`
+	ID        GirderID               `json:"_id"`
+	ModelType string                 `json:"_modelType"`
+	Name      string                 `json:"name"`
+	Meta      map[string]interface{} `json:"meta"`
+	Size      int64                  `json:"size"`
+	Created   string                 `json:"created"`
+	Updated   string                 `json:"updated"`
 }
 
 type GirderTokenResponse struct {
 	AuthToken struct {
-		Token string `json:"token"`
+		Token   string `json:"token"`
+		Expires string `json:"expires"`
 	} `json:"authToken"`
 	User struct {
 		ID    string `json:"_id"`
@@ -22,6 +29,18 @@ type GirderTokenResponse struct {
 	} `json:"user"`
 }
 
+// token returns the token of the response, whose expiry is unknown if girder sent one
+// which can't be parsed.
+func (r *GirderTokenResponse) token() *Token {
+	expires, _ := ParseTime(r.AuthToken.Expires)
+	return &Token{Token: r.AuthToken.Token, Expires: expires}
+}
+
+type GirderAPIKey struct {
+	ID  GirderID `json:"_id"`
+	Key string   `json:"key"`
+}
+
 type GirderUser struct {
 	Email string `json:"email"`
 }
@@ -38,15 +57,31 @@ type ResourceMap map[string]*Resource
 
 // Resource represents a local path and the relationship to a Girder resource
 type Resource struct {
-	Path string
-	Size int64
-	Type string
+	Path    string
+	Size    int64
+	Type    string
+	ModTime time.Time
+
+	// RemoteUpdated is when the girder resource was last updated, if known
+	RemoteUpdated string
+
+	// LinkTarget is set for symbolic links which are preserved rather than followed
+	LinkTarget string
+
+	// Contents are the files of an item downloaded into an item directory, non-nil
+	// (though possibly empty) when the item was synced that way.
+	Contents []*Resource
 
 	GirderID   GirderID
 	GirderType string
 
 	SkipSync   bool
 	SkipReason string
+
+	// Action is what sync did, or during a dry run would do, with this resource
+	// e.g. "create folder", "upload", "replace", "skip", along with why.
+	Action       string
+	ActionReason string
 }
 
 func (m ResourceMap) Parent(resource *Resource) *Resource {
@@ -54,8 +89,31 @@ func (m ResourceMap) Parent(resource *Resource) *Resource {
 }
 
 type GirderFile struct {
-	ID   GirderID `json:"_id"`
-	Size int64    `json:"size"`
+	ID      GirderID `json:"_id"`
+	Name    string   `json:"name"`
+	Size    int64    `json:"size"`
+	Sha512  string   `json:"sha512"`
+	Created string   `json:"created"`
+	Updated string   `json:"updated"`
+}
+
+// ModTime returns the last time the contents of the file changed, as best
+// as can be determined from the server.
+func (f GirderFile) ModTime() (time.Time, error) {
+	timestamp := f.Updated
+	if timestamp == "" {
+		timestamp = f.Created
+	}
+	return ParseTime(timestamp)
+}
+
+// ParseTime parses the timestamps girder returns, which may or may not
+// include a timezone depending on the server version.
+func ParseTime(timestamp string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02T15:04:05", timestamp)
 }
 
 type GirderError struct {
@@ -2,6 +2,7 @@ package girder
 
 import (
 	"testing"
+	"time"
 )
 
 func TestResourceMap_Parent(t *testing.T) {
@@ -18,3 +19,14 @@ func TestResourceMap_Parent(t *testing.T) {
 		t.Errorf("Expected parent %v, got %v", parent, got)
 	}
 }
+
+func TestGirderTokenResponse_token(t *testing.T) {
+	want := time.Date(2026, 11, 17, 10, 30, 0, 0, time.UTC)
+	for _, expires := range []string{"2026-11-17T10:30:00.000000+00:00", "2026-11-17T10:30:00.000000", "2026-11-17T10:30:00"} {
+		r := new(GirderTokenResponse)
+		r.AuthToken.Token, r.AuthToken.Expires = "token", expires
+		if got := r.token(); !got.Expires.Equal(want) {
+			t.Errorf("token() with expiry %s expires at %s, want %s", expires, got.Expires, want)
+		}
+	}
+}
@@ -9,5 +9,7 @@ require (
 	github.com/hashicorp/go-retryablehttp v0.6.6 // v0.6.7 causes too many open files on test-dkc.sh
 	github.com/hashicorp/go-version v1.2.1
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/crypto v0.0.0-20201124201722-c8d3bf9c5392
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
@@ -3,11 +3,15 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/danlamanna/rivet/commands"
 	"github.com/danlamanna/rivet/config"
+	"github.com/danlamanna/rivet/filter"
 	"github.com/danlamanna/rivet/girder"
 	"github.com/danlamanna/rivet/templates"
+	"github.com/danlamanna/rivet/transfer"
+	"github.com/danlamanna/rivet/util"
 	"github.com/danlamanna/rivet/version"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
@@ -15,28 +19,74 @@ import (
 )
 
 var (
-	app     = kingpin.New("rivet", "sync files to girder")
-	auth    = app.Flag("auth", "Authentication credentials, can be username:password, a token, or an api key`").Envar("RIVET_AUTH").Short('a').String()
-	url     = app.Flag("url", "URL of the girder instance, e.g. data.kitware.com, somedomain.com/api/v1").Envar("RIVET_URL").Short('u').String()
-	verbose = app.Flag("verbose", "Increase verbosity, can be passed up to two times.").Short('v').Counter()
+	app         = kingpin.New("rivet", "sync files to girder")
+	auth        = app.Flag("auth", "Authentication credentials, can be username:password, a token, or an api key`").Envar("RIVET_AUTH").Short('a').String()
+	url         = app.Flag("url", "URL of the girder instance, e.g. data.kitware.com, somedomain.com/api/v1").Envar("RIVET_URL").Short('u').String()
+	apiKey      = app.Flag("api-key", "An api key to authenticate with").Envar("RIVET_API_KEY").String()
+	token       = app.Flag("token", "A token to authenticate with").Envar("RIVET_TOKEN").String()
+	username    = app.Flag("username", "A username to log in with, whose password is prompted for or read from RIVET_PASSWORD").Envar("RIVET_USERNAME").String()
+	otp         = app.Flag("otp", "A one-time password to log in with, if --username has two-factor authentication").String()
+	profileName = app.Flag("profile", "Name of the configuration profile to use").Envar("RIVET_PROFILE").String()
+	verbose     = app.Flag("verbose", "Increase verbosity, can be passed up to two times.").Short('v').Counter()
+
+	retries      = app.Flag("retries", "How many times to retry failed requests to girder").Default("4").Int()
+	retryMaxWait = app.Flag("retry-max-wait", "The longest to wait between retries, e.g. 30s").Default("30s").Duration()
+	timeout      = app.Flag("timeout", "How long to wait for girder to respond to a request, e.g. 60s").Default("60s").Duration()
+	maxConns     = app.Flag("max-connections", "The most connections to keep open to girder").Default("32").Int()
 
 	// hidden global flags
 	noConfigFile = app.Flag("no-config", "Skip loading a configuration file").Bool()
 
 	// configure command
-	configure = app.Command("configure", "")
+	configure        = app.Command("configure", "")
+	credentialStore  = configure.Flag("credential-store", "Where to keep the credentials, one of config, encrypted, or helper").Enum(config.CredentialStores...)
+	createAPIKey     = configure.Flag("create-api-key", "Create an api key to store when logging in with a password").Bool()
+	credentialHelper = configure.Flag("credential-helper", "A git style credential helper command to keep the credentials with").String()
+
+	// profiles command
+	profilesCmd           = app.Command("profiles", "")
+	profilesListCmd       = profilesCmd.Command("list", "")
+	profilesShowCmd       = profilesCmd.Command("show", "")
+	profilesShowName      = profilesShowCmd.Arg("name", "").String()
+	profilesRemoveCmd     = profilesCmd.Command("remove", "")
+	profilesRemoveName    = profilesRemoveCmd.Arg("name", "").Required().String()
+	profilesSetDefaultCmd = profilesCmd.Command("set-default", "")
+	profilesSetDefault    = profilesSetDefaultCmd.Arg("name", "").Required().String()
 
 	// sync command
 	sync   = app.Command("sync", "sync a local directory to or from a girder folder")
 	source = sync.Arg("source", "source directory or girder folder").Required().String()
 	dest   = sync.Arg("dest", "dest directory or girder folder").Required().String()
 
+	deleteFlag       = sync.Flag("delete", "Delete files from the destination which don't exist in the source").Bool()
+	maxDelete        = sync.Flag("max-delete", "Don't delete anything if more than this many files/folders would be deleted").Default("0").Int()
+	dryRun           = sync.Flag("dry-run", "Print what would be transferred without making any changes").Bool()
+	includes         = sync.Flag("include", "Sync paths matching this gitignore style pattern even if they're excluded, may be repeated").Strings()
+	excludes         = sync.Flag("exclude", "Skip paths matching this gitignore style pattern, may be repeated").Strings()
+	symlinks         = sync.Flag("symlinks", "How to handle symbolic links, one of skip, follow, or preserve").Default("skip").Enum("skip", "follow", "preserve")
+	fullRescan       = sync.Flag("full-rescan", "Check every file against girder, ignoring what previous syncs recorded").Bool()
+	compare          = sync.Flag("compare", "How to determine whether a file has changed, one of size, mtime, or checksum").Default("size").Enum("size", "mtime", "checksum")
+	metadata         = sync.Flag("metadata", "How to sync folder and item metadata, one of none or sidecar").Default("none").Enum("none", "sidecar")
+	itemLayout       = sync.Flag("item-layout", "How to sync items without exactly one file, one of skip or directory").Default("skip").Enum("skip", "directory")
+	createDest       = sync.Flag("create-dest", "Create folders missing from the end of a girder destination path").Bool()
+	workers          = sync.Flag("workers", "How many items and files to sync at once (default 10)").Int()
+	folderWorkers    = sync.Flag("folder-workers", "How many folders to create at once (default 4)").Int()
+	chunkParallelism = sync.Flag("chunk-parallelism", "How many chunks of a single file to upload at once, for assetstores which accept chunks out of order, unlike stock girder (default 1)").Int()
+	chunkSize        = sync.Flag("chunk-size", "How much of a file to upload per request, e.g. 64M (default 16M)").String()
+	bwlimit          = sync.Flag("bwlimit", "Limit the rate files are transferred at, e.g. 20M, or by time of day, e.g. 08:00-18:00=5M,off").String()
+	noProgress       = sync.Flag("no-progress", "Don't display the progress of the sync, which is only displayed on a terminal").Bool()
+	output           = sync.Flag("output", "How to report progress, text or json for a newline delimited JSON event stream on stdout").Default("text").Enum("text", "json")
+
+	// logout command
+	logoutCmd = app.Command("logout", "")
+
 	// version command
 	versionCmd = app.Command("version", "")
 
 	apiCreateFolderCmd = app.Command("api-create-folder", "")
 	apiDest            = apiCreateFolderCmd.Arg("dest", "").Required().String()
 	apiPath            = apiCreateFolderCmd.Arg("path", "").Required().String()
+	apiCreateDest      = apiCreateFolderCmd.Flag("create-dest", "Create folders missing from the end of a girder destination path").Bool()
 )
 
 func main() {
@@ -49,6 +99,9 @@ func main() {
 	if len(os.Args) >= 3 && os.Args[1] == "help" && os.Args[2] == "configure" {
 		fmt.Print(fmt.Errorf(templates.ConfigureUsageTemplate))
 		os.Exit(1)
+	} else if len(os.Args) >= 3 && os.Args[1] == "help" && os.Args[2] == "profiles" {
+		fmt.Print(fmt.Errorf(templates.ProfilesUsageTemplate))
+		os.Exit(1)
 	} else if len(os.Args) >= 3 && os.Args[1] == "help" && os.Args[2] == "sync" {
 		fmt.Print(fmt.Errorf(templates.SyncUsageTemplate))
 		os.Exit(1)
@@ -70,28 +123,95 @@ func main() {
 	} else {
 		ctx.Logger.Level = logrus.InfoLevel
 	}
+	ctx.Client = girder.NewClient(ctx, girder.ClientOptions{
+		Retries:         *retries,
+		RetryWaitMax:    *retryMaxWait,
+		Timeout:         *timeout,
+		MaxConnsPerHost: *maxConns,
+	})
 
-	// fill in auth/url, defaulting to the "default" profile
+	// fill in auth/url from --profile, defaulting to the default profile
+	var tokenProfile string
 	if !*noConfigFile {
-		profile, err := config.ReadDefaultProfile(ctx)
+		profile, err := config.ReadProfile(ctx, *profileName)
 		if err != nil {
 			log.Fatal(err)
 		}
+		// configure creates profiles which don't exist yet
+		if profile == nil && *profileName != "" && (res == "sync" || res == "api-create-folder") {
+			fmt.Printf("profile %s does not exist, see rivet profiles list\n", *profileName)
+			os.Exit(commands.ExitUsage)
+		}
 
 		if profile != nil {
-			ctx.Logger.Debug("loaded credentials from configuration file")
-			ctx.Auth = profile.Auth
+			// credentials may need a passphrase to read, so they're only read if needed
+			credentialsGiven := *auth != "" || *apiKey != "" || *token != "" || *username != ""
+			if !credentialsGiven && (res == "sync" || res == "api-create-folder") {
+				if ctx.Auth, err = config.ReadCredentials(ctx, profile); err != nil {
+					log.Fatal(err)
+				}
+				ctx.AuthType = profile.AuthType
+				ctx.Logger.Debug("loaded credentials from configuration file")
+			}
+			tokenProfile = profile.Name
 			ctx.URL = profile.URL
+			ctx.Workers = profile.Workers
+			ctx.FolderWorkers = profile.FolderWorkers
+			ctx.ChunkParallelism = profile.ChunkParallelism
+			if *chunkSize == "" {
+				*chunkSize = profile.ChunkSize
+			}
 		}
 	}
 
 	// override default profile with envvars/flags
 	if *auth != "" {
-		ctx.Auth = *auth
+		ctx.Auth, ctx.AuthType = *auth, ""
 	}
 	if *url != "" {
 		ctx.URL = *url
 	}
+	if *workers != 0 {
+		ctx.Workers = *workers
+	}
+	if *folderWorkers != 0 {
+		ctx.FolderWorkers = *folderWorkers
+	}
+	if *chunkParallelism != 0 {
+		ctx.ChunkParallelism = *chunkParallelism
+	}
+
+	// typed credentials override --auth, whose type has to be guessed
+	if (*apiKey != "" && *token != "") || (*apiKey != "" && *username != "") || (*token != "" && *username != "") {
+		fmt.Println("only one of --api-key, --token, and --username may be passed")
+		os.Exit(commands.ExitUsage)
+	} else if *apiKey != "" {
+		ctx.Auth, ctx.AuthType = *apiKey, girder.AuthAPIKey
+	} else if *token != "" {
+		ctx.Auth, ctx.AuthType = *token, girder.AuthToken
+	} else if *username != "" && (res == "configure" || res == "sync" || res == "api-create-folder") {
+		if strings.Contains(*username, ":") {
+			fmt.Println("--username can't contain a colon")
+			os.Exit(commands.ExitUsage)
+		}
+		password := os.Getenv("RIVET_PASSWORD")
+		if password == "" {
+			var err error
+			if password, err = util.ReadPassword(fmt.Sprintf("password for %s: ", *username)); err != nil || password == "" {
+				fmt.Println("--username needs a password, which is prompted for, read from stdin, or from RIVET_PASSWORD")
+				os.Exit(commands.ExitUsage)
+			}
+		}
+		ctx.Auth, ctx.AuthType = *username+":"+password, girder.AuthPassword
+	}
+
+	ctx.OTP = *otp
+	if util.IsTerminal(os.Stdin) {
+		ctx.PromptOTP = func() (string, error) {
+			fmt.Fprint(os.Stderr, "one-time password: ")
+			return util.ReadLine(os.Stdin)
+		}
+	}
 
 	if res == "" {
 		fmt.Printf(`usage: rivet [options] [subcommand] [arguments]
@@ -99,35 +219,105 @@ To see help text, you can run:
 
 rivet help
 rivet help <subcommand>`)
-		os.Exit(1)
+		os.Exit(commands.ExitUsage)
 	}
 
 	if newerVersion, _ := version.IsNewVersionAvailable(); newerVersion != "" {
-		fmt.Printf("Your version of rivet (v%s) is out of date.\n", version.Version)
-		fmt.Printf("Download the newest version (v%s) from https://github.com/danlamanna/rivet/releases.\n\n", newerVersion)
+		// keep stdout to the event stream
+		out := os.Stdout
+		if *output == transfer.OutputJSON {
+			out = os.Stderr
+		}
+		fmt.Fprintf(out, "Your version of rivet (v%s) is out of date.\n", version.Version)
+		fmt.Fprintf(out, "Download the newest version (v%s) from https://github.com/danlamanna/rivet/releases.\n\n", newerVersion)
 	}
 
 	switch res {
 	case "configure":
-		commands.Configure(ctx)
+		if *credentialHelper != "" && *credentialStore == "" {
+			*credentialStore = config.CredentialStoreHelper
+		}
+		commands.Configure(ctx, &config.Profile{
+			Name:             *profileName,
+			CredentialStore:  *credentialStore,
+			CredentialHelper: *credentialHelper,
+		}, *createAPIKey)
 	case "sync":
 		if ctx.URL == "" {
 			fmt.Println("See --url flag")
-			os.Exit(1)
+			os.Exit(commands.ExitUsage)
 		}
 
-		validURL, err := girder.GetValidURL(ctx.URL)
+		validURL, err := girder.GetValidURL(ctx, ctx.URL)
 		ctx.URL = validURL
 
 		if err != nil {
 			log.Fatal(err)
 		}
+		if tokenProfile != "" {
+			ctx.TokenCache = config.NewTokenCache(tokenProfile, ctx.URL)
+		}
 
-		commands.Sync(ctx, source, dest)
+		ctx.Compare = *compare
+		ctx.Delete = *deleteFlag
+		ctx.MaxDelete = *maxDelete
+		ctx.DryRun = *dryRun
+		ctx.Symlinks = *symlinks
+		ctx.FullRescan = *fullRescan
+		ctx.CreateDestination = *createDest
+		ctx.Metadata = *metadata
+		ctx.ItemLayout = *itemLayout
+		if ctx.Workers < 0 || ctx.FolderWorkers < 0 || ctx.ChunkParallelism < 0 {
+			fmt.Println("--workers, --folder-workers, and --chunk-parallelism must be positive")
+			os.Exit(commands.ExitUsage)
+		}
+		if *bwlimit != "" {
+			schedule, err := girder.ParseBandwidthSchedule(*bwlimit)
+			if err != nil {
+				fmt.Printf("invalid --bwlimit, %s\n", err)
+				os.Exit(commands.ExitUsage)
+			}
+			ctx.Bandwidth = girder.NewBandwidthLimiter(schedule)
+		}
+		if *chunkSize != "" {
+			if ctx.ChunkSize, err = util.ParseSize(*chunkSize); err != nil || ctx.ChunkSize == 0 {
+				fmt.Println("--chunk-size must be a positive size such as 16M")
+				os.Exit(commands.ExitUsage)
+			}
+		}
+		if *output == transfer.OutputJSON {
+			ctx.Events = girder.NewEventStream(os.Stdout)
+		} else if !*noProgress && util.IsTerminal(os.Stdout) {
+			ctx.Progress = os.Stdout
+		}
+		ctx.Filter, err = filter.New(*includes, *excludes)
+		if err != nil {
+			log.Error(err)
+			os.Exit(commands.ExitUsage)
+		}
+		os.Exit(commands.Sync(ctx, source, dest))
+	case "profiles list":
+		os.Exit(commands.ProfilesList(ctx))
+	case "profiles show":
+		if *profilesShowName == "" {
+			*profilesShowName = *profileName
+		}
+		os.Exit(commands.ProfilesShow(ctx, *profilesShowName))
+	case "profiles remove":
+		os.Exit(commands.ProfilesRemove(ctx, *profilesRemoveName))
+	case "profiles set-default":
+		os.Exit(commands.ProfilesSetDefault(ctx, *profilesSetDefault))
 	case "version":
 		commands.Version()
 
+	case "logout":
+		os.Exit(commands.Logout(ctx, *profileName))
+
 	case "api-create-folder":
+		if tokenProfile != "" {
+			ctx.TokenCache = config.NewTokenCache(tokenProfile, ctx.URL)
+		}
+		ctx.CreateDestination = *apiCreateDest
 		commands.APICreateFolder(ctx, *apiDest, *apiPath)
 	}
 }
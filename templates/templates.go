@@ -4,7 +4,9 @@ var DefaultUsageTemplate = `NAME
 	rivet - a utility for syncing files to and from girder
 
 SYNOPSIS
-	rivet configure
+	rivet configure [--profile=NAME]
+	rivet profiles list|show|remove|set-default [NAME]
+	rivet logout [--profile=NAME]
 	rivet sync source-directory girder://girder-folder-id
 	rivet sync girder://girder-folder-id destination-directory
 	rivet version
@@ -17,16 +19,49 @@ CONFIGURATION
 	rivet will use a configuration file. To create this configuration file
 	you may run the rivet configure command and answer the prompted questions.
 
+	The configuration file may hold several profiles, such as one per girder
+	instance. The --profile flag, or the RIVET_PROFILE environment variable,
+	chooses which one to use, otherwise the default profile is used. See rivet
+	help profiles.
+
+	Credentials are exchanged for a token, which is cached for the profile in
+	$HOME/.rivet/tokens.json and reused by later runs until it's about to
+	expire, rather than creating a new token every time. If girder stops
+	accepting the token during a sync, rivet authenticates again and carries
+	on. rivet logout deletes the cached token of a profile from girder and the
+	cache.
+
 SUBCOMMANDS
-	See rivet help configure and rivet help sync.
+	See rivet help configure, rivet help profiles, and rivet help sync.
 
 OPTIONS
 	-a, --auth 
 	    Credentials for authenticating with a remote girder instance. This may
 	    be a username:password pair, an API key, or an existing token. Credentials
 	    are immediately exchanged for a temporary token. This overrides the RIVET_AUTH
+	    environment variable. Which kind of credentials were given is guessed from
+	    their format, an API key being 40 characters and a token 64, so prefer
+	    --api-key, --token, or --username, which override --auth.
+
+	--api-key=KEY
+	    An API key to authenticate with. This overrides the RIVET_API_KEY
 	    environment variable.
 
+	--token=TOKEN
+	    An existing token to authenticate with. This overrides the RIVET_TOKEN
+	    environment variable.
+
+	--username=USERNAME
+	    A username to log in with. Its password is read from the RIVET_PASSWORD
+	    environment variable, otherwise it's prompted for, or read from stdin if
+	    that isn't a terminal. This overrides the RIVET_USERNAME environment
+	    variable.
+
+	--otp=CODE
+	    A one-time password to log in with, for users with two-factor
+	    authentication. If girder requires one and it isn't passed, it's
+	    prompted for on a terminal.
+
 	-u, --url 
 	    A location to a remote girder instance e.g. data.kitware.com, 
 	    https://some-girder-instance.org/api/v1. The scheme is assumed
@@ -37,29 +72,108 @@ OPTIONS
 	    Displays extra debugging information. If passed once it will set the log level
 	    to debug, if set twice it will set it to trace. Trace is particularly noisy and 
 	    will print every http request made by rivet.
+
+	--retries=4
+	    How many times to retry a request which fails due to a connection error or
+	    a server error from girder.
+
+	--retry-max-wait=30s
+	    The longest to wait between retries, which back off exponentially.
+
+	--timeout=60s
+	    How long to wait for girder to start responding to a request. This doesn't
+	    limit how long uploading or downloading a file may take.
+
+	--max-connections=32
+	    The most connections to girder rivet will open. Connections are kept open
+	    and reused by subsequent requests.
+
+	--profile=NAME
+	    The profile of the configuration file to use rather than the default
+	    profile. This overrides the RIVET_PROFILE environment variable.
 `
 
 var ConfigureUsageTemplate = `SYNOPSIS
-	rivet configure
+	rivet configure [--profile=NAME]
 
 DESCRIPTION
-	Configures a default profile to use for future calls to rivet. This
-	saves authentication credentials and remote url of a girder instance
-	to a configuration file at $HOME/.rivet/config.toml.
+	Configures a profile to use for future calls to rivet. This saves
+	authentication credentials and remote url of a girder instance to a
+	configuration file at $HOME/.rivet/config.toml.
+
+	Credentials passed with --api-key, --token, or --username aren't prompted
+	for, and their kind is remembered rather than guessed from their format.
+
+	Without --profile the default profile is configured. Configuring a profile
+	which already exists replaces its url and credentials, leaving any other
+	profiles and settings in the configuration file as they were.
+
+	Only an API key or token is stored. A username:password pair is exchanged
+	for a token, which is stored instead of the password, so configure needs to
+	be run again once the token expires. The configuration file is only
+	readable by its owner, and rivet warns if its permissions allow others to
+	read it.
+
+	Logging in with a one-time password offers to create an API key to store
+	instead of the token, since the token can only be replaced by logging in
+	again with another one-time password.
+
+OPTIONS
+	--create-api-key
+	    Create an API key to store when logging in with a password, rather than
+	    storing the token of the login. The key is limited to reading and
+	    writing data and reading user information, and is named after this
+	    machine so it can be found and deactivated in girder.
+
+	--credential-store=config
+	    Where to keep the credentials of the profile. config keeps them in the
+	    configuration file. encrypted keeps them in $HOME/.rivet/credentials.enc,
+	    encrypted with a passphrase which is read from the RIVET_PASSPHRASE
+	    environment variable or prompted for. helper keeps them with the
+	    --credential-helper command. Reconfiguring a profile keeps its store
+	    unless this is passed.
+
+	--credential-helper=COMMAND
+	    Keep the credentials with COMMAND, implying --credential-store=helper.
+	    This uses the protocol of git credential helpers, so they may be reused:
+	    COMMAND is run by the shell with get, store, or erase appended, and the
+	    girder url and the name of the profile, as the username, are written to
+	    it. The credentials are its password. For instance,
+	    --credential-helper 'git credential-cache' keeps them in memory.
 
 NOTES
 	Environment variables such as RIVET_AUTH and RIVET_URL, as well as flags, will
 	override settings configured with rivet configure.
 `
+var ProfilesUsageTemplate = `SYNOPSIS
+	rivet profiles list
+	rivet profiles show [NAME]
+	rivet profiles remove NAME
+	rivet profiles set-default NAME
+
+DESCRIPTION
+	Manages the profiles of the configuration file, which are created with
+	rivet configure --profile=NAME.
+
+	list prints the name and url of each profile, marking the default with a *.
+	show prints the settings of a profile, the default one unless NAME or
+	--profile is given, with its credentials masked. remove deletes a profile.
+	set-default makes a profile the one used when --profile isn't given.
+
+NOTES
+	Unless set-default has been used, the default profile is the one named
+	default, or the first profile if there isn't one.
+`
 var SyncUsageTemplate = `SYNOPSIS
 	rivet sync source-directory girder://girder-folder-id
 	rivet sync girder://girder-folder-id destination-directory
 
 DESCRIPTION
 	The sync command will copy files and folders from a local machine to a 
-	folder on a remote girder instance, or vice versa. Sync uses the size of
-	files to determine whether it can skip sending the data to the remote.
-	Note that symbolic links will be skipped.
+	folder on a remote girder instance, or vice versa. By default sync uses the
+	size of files to determine whether it can skip sending the data to the
+	remote, see --compare for alternatives. By default symbolic links will be
+	skipped, see --symlinks for alternatives.
 
 	The sync command requires a URL and set of credentials to use for connecting
 	to the remote. These can be preconfigured with rivet configure, or passed 
@@ -74,9 +188,187 @@ USAGE
 	folder with the ID of 5d3bf0f6877dfcc902333a40. That is, it will make the
 	girder folder appear the same as local-folder.
 
+	Instead of an ID, a girder folder may be given by its path, either within a
+	collection or a user's Public or Private folder:
+
+		rivet sync ./local-folder girder://collection/Lab/data/2019
+		rivet sync girder://user/jdoe/Private/results ./results
+
+	The root of a collection or user may also be synced, such as
+	girder://collection/Lab to mirror an entire collection. Since girder only
+	allows folders there, files directly within the source directory can't be
+	uploaded to a collection or user root and are reported as failures.
+
 	Running an identical command a second time should result in no changes,
 	assuming the local and remote haven't been modified by any other tools.
 
+	Uploads which are interrupted are recorded in $HOME/.rivet/uploads.json
+	and continue where girder left off the next time the same file is synced,
+	as long as it hasn't been modified in the meantime. Downloads are written
+	to a hidden .rivetpart file next to their destination, which is resumed
+	if interrupted and only replaces the destination once it's verified. It's
+	removed if the destination turns out to be unchanged, or by --delete if
+	the file no longer exists in girder.
+
+	Interrupting a sync with Ctrl-C (or SIGTERM) stops it from starting any
+	more transfers and aborts those in progress, which are resumed by the next
+	sync. A summary of what was synced is printed and rivet exits with status
+	130. Interrupting a second time exits immediately.
+
+OPTIONS
+	--create-dest
+	    Create any folders missing from the end of a girder destination path,
+	    like mkdir -p. Without this, syncing to a path which doesn't exist
+	    fails. The collection or user at the start of the path must exist.
+	    With --dry-run, the missing folders are planned rather than created.
+
+	--dry-run
+	    Scan the source and destination and print a plan of the folders, items,
+	    and files that would be created, replaced, skipped, or deleted, without
+	    making any changes.
+
+	--exclude=PATTERN
+	    Skip files and directories matching the gitignore style PATTERN, which
+	    supports **, character classes, and a trailing / to only match
+	    directories. May be passed multiple times. Patterns are also read from
+	    .rivetignore files in the source directory and its subdirectories.
+	    Excluded paths are never deleted by --delete.
+
+	--include=PATTERN
+	    Sync files and directories matching PATTERN even if they would otherwise
+	    be excluded. May be passed multiple times. For instance, to only sync
+	    tiff files use --exclude '*' --include '*/' --include '*.tif'.
+
+	--symlinks=skip|follow|preserve
+	    How to handle symbolic links. skip (the default) ignores them. follow
+	    syncs whatever the link points to, skipping links which would cause a
+	    cycle. preserve stores the target of the link as metadata on an empty
+	    girder item, which is recreated as a link when syncing from girder with
+	    --symlinks=preserve. Links with absolute targets, or targets outside of
+	    the destination, aren't recreated.
+
+	--full-rescan
+	    After each sync, rivet records what was transferred in
+	    $HOME/.rivet/state so the next sync only asks girder about files which
+	    changed locally (or for downloads, items which changed remotely). This
+	    ignores that record and checks every file, which is useful if the
+	    destination was modified by other tools.
+
+	--compare=size|mtime|checksum
+	    How to determine whether a file differs between the source and the
+	    destination. size (the default) only compares file sizes. mtime also
+	    transfers files whose source is newer than the destination. checksum
+	    also compares the sha512 of the local file with the one girder has
+	    recorded, falling back to size when girder has no checksum.
+
+	--item-layout=skip|directory
+	    How to sync girder items which don't have exactly one file. skip (the
+	    default) ignores them. directory syncs such an item as a local
+	    directory named after the item with .item appended, containing a file
+	    for each file of the item, or nothing for an empty item. Items with a
+	    single file named differently than the item are synced this way too,
+	    so uploading them again recreates the same file. Directories ending in
+	    .item are uploaded as items rather than folders, and may only contain
+	    files. With --delete, files removed from an item directory are removed
+	    from the item.
+
+	--metadata=none|sidecar
+	    How to sync the metadata of girder folders and items. none (the
+	    default) ignores it. sidecar stores the metadata of each item and
+	    folder as JSON in a file named after it with .girder.json appended,
+	    e.g. scan.tif.girder.json next to scan.tif, or results.girder.json
+	    next to the results directory. The sidecar of an item directory is
+	    named after the item, e.g. scans.girder.json for scans.item. When
+	    downloading the sidecars are
+	    written, and removed if the metadata is. When uploading, metadata is
+	    set to the contents of each sidecar, only changing the keys which
+	    differ. Items and folders without a sidecar are left alone.
+
+	--workers=10
+	    How many items to create and files to upload or download at once.
+	    Raise this on fast networks, or lower it to put less load on girder.
+
+	--folder-workers=4
+	    How many folders to create at once when uploading. Folders are created
+	    one depth at a time, since each needs its parent to exist first.
+
+	--chunk-parallelism=1
+	    How many chunks of a single file to upload at once, which speeds up
+	    uploading very large files to assetstores that accept chunks out of
+	    order. Stock girder doesn't accept them out of order, so this needs
+	    an assetstore which does, such as one backed by S3 multipart uploads.
+	    A single chunk is sent out of order first to find out, and if girder
+	    refuses it chunks are sent one at a time for the rest of the sync.
+
+	--chunk-size=16M
+	    How much of a file to send to girder per request, with a suffix of K,
+	    M, or G. At most chunk-size x chunk-parallelism x workers bytes of
+	    files are held in memory while uploading.
+
+	    These four may also be set for a profile in $HOME/.rivet/config.toml
+	    with workers, folder_workers, chunk_parallelism, and chunk_size, which
+	    the flags override.
+
+	--bwlimit=RATE
+	    Limit how fast files are uploaded and downloaded, in bytes per second
+	    with a suffix of K, M, or G, e.g. 20M. The limit is shared by every
+	    worker. It may vary by time of day with a comma separated schedule of
+	    HH:MM-HH:MM=RATE entries and a RATE which applies at any other time,
+	    e.g. 08:00-18:00=5M,off to only limit transfers during the day. off is
+	    unlimited, and times are in the local time zone.
+
+	--no-progress
+	    When stdout is a terminal, rivet displays how much of the sync has been
+	    transferred, the current rate and estimated time remaining, and the
+	    files each worker is transferring. This turns the display off. It's
+	    never displayed when stdout isn't a terminal, during a dry run, or
+	    with --output=json.
+
+	--output=text|json
+	    How to report the progress of the sync. text (the default) only logs
+	    to stderr. json also writes a JSON object per line to stdout for each
+	    step of the sync, with an "event" field of:
+
+	      scan_complete   the source was listed (dirs, files, excluded)
+	      folder_created  a folder or local directory was created (path,
+	                      girder_id)
+	      item_created    an item to upload into was created (path, girder_id)
+	      upload_started  a file is being uploaded (path, size, offset)
+	      chunk_uploaded  part of a file was sent (path, chunk, chunks, size)
+	      file_skipped    a path was up to date or can't be synced (reason)
+	      file_failed     a path couldn't be synced (reason)
+	      summary         the final event, listing the paths which succeeded,
+	                      were skipped, or failed, and the number interrupted
+	                      and excluded, or the error if the sync couldn't be
+	                      started
+
+	    Fields which don't apply are omitted. With --dry-run, the plan is
+	    printed to stderr.
+
+	--delete
+	    Delete files and folders from the destination which don't exist in the
+	    source, making the destination an exact mirror of the source. Deleting
+	    happens after everything else is synced. Nothing is deleted if girder
+	    can't be fully listed, and local paths which were skipped or couldn't
+	    be read are left alone in girder.
+
+	--max-delete=N
+	    When used with --delete, refuse to delete anything if more than N files
+	    and folders would be removed. Defaults to 0, which means no limit.
+
+EXIT STATUS
+	0    everything was synced, or was already up to date
+	1    some files or folders failed to sync or to be deleted by --delete,
+	     --max-delete refused to delete anything, or the sync couldn't start
+	2    invalid arguments, such as a source directory which doesn't exist
+	3    the credentials were rejected by girder
+	130  the sync was interrupted
+
+	Files which can't be represented at the destination, such as girder items
+	with several files without --item-layout=directory, are reported as
+	skipped and don't cause a failure. Failures are listed with their reason
+	in the summary printed at the end of every sync.
+
 NOTES
 	Environment variables such as RIVET_AUTH and RIVET_URL, as well as flags, will
 	override settings configured with rivet configure.
@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/danlamanna/rivet/config"
+	"github.com/danlamanna/rivet/girder"
+	"github.com/danlamanna/rivet/util"
+)
+
+// syncedFile records a file as it was the last time it was successfully synced.
+type syncedFile struct {
+	Size    int64           `json:"size"`
+	ModTime time.Time       `json:"mtime"`
+	ItemID  girder.GirderID `json:"itemId"`
+	FileID  girder.GirderID `json:"fileId,omitempty"`
+	Sha512  string          `json:"sha512,omitempty"`
+
+	// RemoteUpdated is the updated time of the item when it was downloaded
+	RemoteUpdated string `json:"remoteUpdated,omitempty"`
+}
+
+type syncCacheContents struct {
+	Folders map[string]girder.GirderID `json:"folders"`
+	Files   map[string]*syncedFile     `json:"files"`
+}
+
+// syncCache remembers what was synced between a local directory and a girder folder, so
+// later syncs only need to ask girder about paths which changed locally. Lookups use what
+// was recorded by the previous sync, while everything recorded during this sync replaces
+// it when saved. It is safe for concurrent use.
+type syncCache struct {
+	sync.Mutex
+	file     string
+	root     string
+	previous syncCacheContents
+	current  syncCacheContents
+}
+
+// loadSyncCache reads the cache for syncing between root and the girder folder, which is
+// empty when --full-rescan is passed or no previous sync has completed.
+func loadSyncCache(ctx *girder.Context, root string, folderID girder.GirderID, direction string) *syncCache {
+	cache := &syncCache{
+		root:     root,
+		previous: syncCacheContents{Folders: make(map[string]girder.GirderID), Files: make(map[string]*syncedFile)},
+		current:  syncCacheContents{Folders: make(map[string]girder.GirderID), Files: make(map[string]*syncedFile)},
+	}
+
+	configDir, err := config.Dir()
+	if err != nil {
+		ctx.Logger.Warnf("unable to determine state directory, sync state won't be saved. err: %s", err)
+		return cache
+	}
+	absRoot, _ := filepath.Abs(root)
+	hash := sha1.Sum([]byte(ctx.URL + "|" + string(folderID) + "|" + absRoot + "|" + direction))
+	cache.file = path.Join(configDir, "state", hex.EncodeToString(hash[:])+".json")
+
+	if ctx.FullRescan {
+		return cache
+	}
+
+	contents, err := ioutil.ReadFile(cache.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.Logger.Warnf("failed to read %s, err: %s", cache.file, err)
+		}
+		return cache
+	}
+	if err := json.Unmarshal(contents, &cache.previous); err != nil {
+		ctx.Logger.Warnf("failed to parse %s, err: %s", cache.file, err)
+		cache.previous = cache.current
+		return cache
+	}
+	ctx.Logger.Debugf("loaded sync state from %s", cache.file)
+	return cache
+}
+
+func (c *syncCache) relPath(p string) string {
+	relPath, err := filepath.Rel(c.root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// save writes everything recorded during this sync, replacing the previous state.
+func (c *syncCache) save(ctx *girder.Context) {
+	if c.file == "" || ctx.DryRun {
+		return
+	}
+
+	c.Lock()
+	contents, err := json.Marshal(c.current)
+	c.Unlock()
+	if err == nil {
+		err = util.WriteFileAtomic(c.file, contents, 0600)
+	}
+	if err != nil {
+		ctx.Logger.Warnf("failed to save sync state, err: %s", err)
+	}
+}
+
+// folder returns the ID of the girder folder synced with the local directory p.
+func (c *syncCache) folder(p string) (girder.GirderID, bool) {
+	c.Lock()
+	defer c.Unlock()
+	id, ok := c.previous.Folders[c.relPath(p)]
+	return id, ok
+}
+
+func (c *syncCache) recordFolder(p string, id girder.GirderID) {
+	c.Lock()
+	defer c.Unlock()
+	c.current.Folders[c.relPath(p)] = id
+}
+
+// unchangedFile returns what was recorded about the local file p the last time it was
+// synced, if its size and modification time are the same as they were then.
+func (c *syncCache) unchangedFile(p string, size int64, modTime time.Time) (*syncedFile, bool) {
+	c.Lock()
+	defer c.Unlock()
+	synced, ok := c.previous.Files[c.relPath(p)]
+	if !ok || synced.Size != size || !synced.ModTime.Equal(modTime) {
+		return nil, false
+	}
+	return synced, true
+}
+
+func (c *syncCache) recordFile(p string, synced *syncedFile) {
+	c.Lock()
+	defer c.Unlock()
+	c.current.Files[c.relPath(p)] = synced
+}
@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_syncCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	ctx := &girder.Context{URL: "https://girder/api/v1", Logger: logrus.New()}
+	root := filepath.Join(dir, "root")
+	modTime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	cache := loadSyncCache(ctx, root, "folder", "upload")
+	cache.recordFolder(filepath.Join(root, "d"), "folderD")
+	cache.recordFile(filepath.Join(root, "d", "f"), &syncedFile{Size: 10, ModTime: modTime, ItemID: "item"})
+	if _, ok := cache.folder(filepath.Join(root, "d")); ok {
+		t.Error("folder recorded during this sync was looked up before being saved")
+	}
+	cache.save(ctx)
+
+	// the next sync of the same destination reuses what was recorded
+	cache = loadSyncCache(ctx, root, "folder", "upload")
+	if id, ok := cache.folder(filepath.Join(root, "d")); !ok || id != "folderD" {
+		t.Errorf("folder(d) = %s, %v, want folderD", id, ok)
+	}
+	if _, ok := cache.folder(filepath.Join(root, "e")); ok {
+		t.Error("folder(e) was found without being recorded")
+	}
+	tests := []struct {
+		name    string
+		size    int64
+		modTime time.Time
+		want    bool
+	}{
+		{"unchanged", 10, modTime, true},
+		{"same time in another zone", 10, modTime.In(time.FixedZone("EST", -5*3600)), true},
+		{"resized", 11, modTime, false},
+		{"modified", 10, modTime.Add(time.Second), false},
+	}
+	for _, tt := range tests {
+		synced, ok := cache.unchangedFile(filepath.Join(root, "d", "f"), tt.size, tt.modTime)
+		if ok != tt.want || (ok && synced.ItemID != "item") {
+			t.Errorf("unchangedFile() of a %s file = %v, %v, want %v", tt.name, synced, ok, tt.want)
+		}
+	}
+
+	// what isn't recorded again is forgotten
+	cache.save(ctx)
+	cache = loadSyncCache(ctx, root, "folder", "upload")
+	if _, ok := cache.folder(filepath.Join(root, "d")); ok {
+		t.Error("folder which wasn't synced again was remembered")
+	}
+}
+
+func Test_syncCacheDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	ctx := &girder.Context{URL: "https://girder/api/v1", Logger: logrus.New()}
+	root := filepath.Join(dir, "root")
+	cache := loadSyncCache(ctx, root, "folder", "upload")
+	cache.recordFolder(filepath.Join(root, "d"), "folderD")
+	cache.save(ctx)
+
+	// each combination of girder, folder, local directory, and direction is kept apart
+	others := []struct {
+		name      string
+		url       string
+		root      string
+		folderID  girder.GirderID
+		direction string
+	}{
+		{"another girder", "https://other/api/v1", root, "folder", "upload"},
+		{"another folder", ctx.URL, root, "other", "upload"},
+		{"another directory", ctx.URL, filepath.Join(dir, "other"), "folder", "upload"},
+		{"the other direction", ctx.URL, root, "folder", "download"},
+	}
+	for _, other := range others {
+		otherCtx := &girder.Context{URL: other.url, Logger: ctx.Logger}
+		if _, ok := loadSyncCache(otherCtx, other.root, other.folderID, other.direction).folder(filepath.Join(other.root, "d")); ok {
+			t.Errorf("sync with %s used the state of another destination", other.name)
+		}
+	}
+
+	ctx.FullRescan = true
+	if _, ok := loadSyncCache(ctx, root, "folder", "upload").folder(filepath.Join(root, "d")); ok {
+		t.Error("--full-rescan used the state of the previous sync")
+	}
+
+	// dry runs leave the state as it was
+	ctx.FullRescan, ctx.DryRun = false, true
+	loadSyncCache(ctx, root, "folder", "upload").save(ctx)
+	if _, ok := loadSyncCache(ctx, root, "folder", "upload").folder(filepath.Join(root, "d")); !ok {
+		t.Error("dry run replaced the state of the previous sync")
+	}
+}
@@ -0,0 +1,76 @@
+package transfer
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+const (
+	CompareSize     = "size"
+	CompareMtime    = "mtime"
+	CompareChecksum = "checksum"
+)
+
+// hashFile computes the hex encoded sha512 of the file at fullPath, streaming
+// it from disk rather than reading it into memory.
+func hashFile(fullPath string) (string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha512.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// filesDiffer determines whether the local file and the remote girder file have
+// different contents according to the comparison mode of the context. It returns
+// a human readable reason when they differ.
+//
+// Girder doesn't allow setting the modification time of a file, so in mtime mode
+// the source is considered changed when it is newer than the destination.
+func filesDiffer(ctx *girder.Context, fullPath string, fi os.FileInfo, remote girder.GirderFile, uploading bool) (bool, string, error) {
+	if remote.Size != fi.Size() {
+		return true, "file sizes differ", nil
+	}
+
+	switch ctx.Compare {
+	case CompareMtime:
+		remoteTime, err := remote.ModTime()
+		if err != nil {
+			ctx.Logger.Debugf("unable to parse remote timestamp for %s, falling back to size", fullPath)
+			return false, "", nil
+		}
+		localTime := fi.ModTime().Truncate(time.Second)
+		remoteTime = remoteTime.Truncate(time.Second)
+		if uploading && localTime.After(remoteTime) {
+			return true, "local file is newer", nil
+		} else if !uploading && remoteTime.After(localTime) {
+			return true, "remote file is newer", nil
+		}
+	case CompareChecksum:
+		if remote.Sha512 == "" {
+			ctx.Logger.Debugf("remote has no checksum for %s, falling back to size", fullPath)
+			return false, "", nil
+		}
+		localHash, err := hashFile(fullPath)
+		if err != nil {
+			return false, "", fmt.Errorf("failed to hash %s, err: %s", fullPath, err)
+		}
+		if localHash != remote.Sha512 {
+			return true, "checksums differ", nil
+		}
+	}
+
+	return false, "", nil
+}
@@ -0,0 +1,61 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_filesDiffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fullPath := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fullPath, []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(fullPath, modTime, modTime)
+	fi, _ := os.Stat(fullPath)
+
+	// sha512 of "abcd"
+	abcdHash := "d8022f2060ad6efd297ab73dcc5355c9b214054b0d1776a136a669d26a7d3b14f73aa0d0ebff19ee333368f0164b6419a96da49e3e481753e7e96b716bdccb6f"
+
+	tests := []struct {
+		name      string
+		compare   string
+		remote    girder.GirderFile
+		uploading bool
+		want      bool
+	}{
+		{"size same", CompareSize, girder.GirderFile{Size: 4}, true, false},
+		{"size differs", CompareSize, girder.GirderFile{Size: 5}, true, true},
+		{"checksum same", CompareChecksum, girder.GirderFile{Size: 4, Sha512: abcdHash}, true, false},
+		{"checksum differs", CompareChecksum, girder.GirderFile{Size: 4, Sha512: "abc"}, true, true},
+		{"checksum missing", CompareChecksum, girder.GirderFile{Size: 4}, true, false},
+		{"mtime local newer", CompareMtime, girder.GirderFile{Size: 4, Created: "2019-01-01T12:00:00.000000+00:00"}, true, true},
+		{"mtime remote newer", CompareMtime, girder.GirderFile{Size: 4, Created: "2021-01-01T12:00:00.000000+00:00"}, true, false},
+		{"mtime remote newer download", CompareMtime, girder.GirderFile{Size: 4, Created: "2021-01-01T12:00:00.000000"}, false, true},
+		{"mtime equal download", CompareMtime, girder.GirderFile{Size: 4, Created: "2020-01-01T12:00:00.123000+00:00"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &girder.Context{Logger: logrus.New(), Compare: tt.compare}
+			got, _, err := filesDiffer(ctx, fullPath, fi, tt.remote, tt.uploading)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("filesDiffer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// listRemoteResources recursively adds every folder and item beneath parentID, a folder,
+// collection, or user depending on parentType, to m keyed by its path joined to prefix.
+// Excluded paths are left out so they're never deleted.
+func listRemoteResources(ctx *girder.Context, parentType string, parentID girder.GirderID, prefix string, m girder.ResourceMap) error {
+	items, err := girder.Items(ctx, parentType, parentID)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		p := path.Join(prefix, item.Name)
+		if ctx.Filter.Excluded(p, false) {
+			continue
+		}
+		m[p] = &girder.Resource{Path: p, Type: "file", GirderID: item.ID, GirderType: "item"}
+	}
+
+	folders, err := girder.Folders(ctx, parentType, parentID)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		p := path.Join(prefix, folder.Name)
+		if ctx.Filter.Excluded(p, true) {
+			continue
+		}
+		m[p] = &girder.Resource{Path: p, Type: "directory", GirderID: folder.ID, GirderType: "folder"}
+		if err := listRemoteResources(ctx, "folder", folder.ID, p, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listLocalResources adds every file and directory beneath root to m, without
+// following symbolic links. Excluded paths are left out so they're never deleted.
+func listLocalResources(ctx *girder.Context, root string, m girder.ResourceMap) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if p == root {
+			return nil
+		}
+
+		// leave unfinished downloads of files still in girder so they can be resumed,
+		// the rest are deleted with the files they were downloads of
+		if isPartialDownload(p) {
+			if _, ok := ctx.ResourceMap[partialDest(p)]; ok {
+				return nil
+			}
+		}
+
+		relPath, _ := filepath.Rel(root, p)
+		if ctx.Filter.Excluded(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fileType := "file"
+		if info.IsDir() {
+			fileType = "directory"
+		}
+		m[p] = &girder.Resource{Path: p, Type: fileType, Size: info.Size()}
+		return nil
+	})
+}
+
+// extraneousResources returns the resources in dest which don't exist in source. Only
+// the top-most resources are returned, since deleting a directory deletes its contents,
+// along with the total number of resources which would be removed.
+func extraneousResources(source girder.ResourceMap, dest girder.ResourceMap) ([]*girder.Resource, int) {
+	extraneous := make(map[string]*girder.Resource)
+	for p, resource := range dest {
+		if sourceResource, ok := source[p]; !ok || sourceResource.Type != resource.Type {
+			extraneous[p] = resource
+		}
+	}
+
+	topMost := make([]*girder.Resource, 0)
+	for p, resource := range extraneous {
+		hasExtraneousAncestor := false
+		for dir := path.Dir(p); dir != path.Dir(dir); dir = path.Dir(dir) {
+			if _, ok := extraneous[dir]; ok {
+				hasExtraneousAncestor = true
+				break
+			}
+		}
+		if !hasExtraneousAncestor {
+			topMost = append(topMost, resource)
+		}
+	}
+	sort.Slice(topMost, func(i, j int) bool { return topMost[i].Path < topMost[j].Path })
+
+	return topMost, len(extraneous)
+}
+
+// withoutPaths returns m without the resources at any of paths, or within them.
+func withoutPaths(m girder.ResourceMap, paths []string) girder.ResourceMap {
+	if len(paths) == 0 {
+		return m
+	}
+
+	kept := make(girder.ResourceMap, len(m))
+	for p, resource := range m {
+		within := false
+		for _, dir := range paths {
+			if p == dir || strings.HasPrefix(p, dir+"/") {
+				within = true
+				break
+			}
+		}
+		if !within {
+			kept[p] = resource
+		}
+	}
+	return kept
+}
+
+// exceedsMaxDelete returns why nothing will be deleted if numDeletions is more than the
+// context allows, logging it, or nil otherwise.
+func exceedsMaxDelete(ctx *girder.Context, root string, numDeletions int) []Outcome {
+	if ctx.MaxDelete > 0 && numDeletions > ctx.MaxDelete {
+		reason := fmt.Sprintf("refusing to delete %d files/folders, which exceeds --max-delete=%d", numDeletions, ctx.MaxDelete)
+		ctx.Logger.Error(reason)
+		return []Outcome{{Path: root, Reason: reason}}
+	}
+	return nil
+}
+
+// deleteRemoteResources removes everything within the girder destination that isn't
+// present locally, returning the paths which were (or during a dry run, would be) deleted
+// and why anything that should have been deleted wasn't.
+func deleteRemoteResources(ctx *girder.Context, destination girder.GirderID) ([]string, []Outcome) {
+	remote := make(girder.ResourceMap)
+	if err := listRemoteResources(ctx, ctx.RootParentType(), destination, "", remote); err != nil {
+		ctx.Logger.Errorf("failed to list remote resources, skipping deletion. err: %s", err)
+		return nil, []Outcome{{Path: ".", Reason: fmt.Sprintf("failed to list remote files/folders to delete, err: %s", err)}}
+	}
+
+	// whatever wasn't walked locally may or may not still exist, so it's kept
+	unwalked := make([]string, 0, len(ctx.Unwalked))
+	for p := range ctx.Unwalked {
+		unwalked = append(unwalked, p)
+	}
+	remote = withoutPaths(remote, unwalked)
+
+	extraneous, numDeletions := extraneousResources(withItemAliases(ctx.ResourceMap), remote)
+	if ctx.ItemLayout == ItemLayoutDirectory {
+		extraneousFiles := extraneousItemFiles(ctx, remote)
+		extraneous = append(extraneous, extraneousFiles...)
+		numDeletions += len(extraneousFiles)
+	}
+	if refused := exceedsMaxDelete(ctx, ".", numDeletions); refused != nil {
+		return nil, refused
+	}
+
+	deleted, failed := make([]string, 0), make([]Outcome, 0)
+	for _, resource := range extraneous {
+		if ctx.DryRun {
+			deleted = append(deleted, resource.Path)
+			continue
+		} else if ctx.Interrupted() {
+			break
+		}
+		ctx.Logger.Infof("deleting: %s\n", resource.Path)
+		if err := girder.DeleteResource(ctx, resource.GirderType, resource.GirderID); err != nil {
+			ctx.Logger.Errorf("failed to delete %s, err: %s", resource.Path, err)
+			failed = append(failed, Outcome{Path: resource.Path, Reason: fmt.Sprintf("failed to delete, err: %s", err)})
+			continue
+		}
+		deleted = append(deleted, resource.Path)
+	}
+	return deleted, failed
+}
+
+// deleteLocalResources removes everything within the local destination that wasn't
+// found in girder, returning the paths which were (or during a dry run, would be) deleted
+// and why anything that should have been deleted wasn't.
+func deleteLocalResources(ctx *girder.Context, dest string) ([]string, []Outcome) {
+	local := make(girder.ResourceMap)
+	if err := listLocalResources(ctx, dest, local); err != nil {
+		ctx.Logger.Errorf("failed to list local files, skipping deletion. err: %s", err)
+		return nil, []Outcome{{Path: dest, Reason: fmt.Sprintf("failed to list local files/folders to delete, err: %s", err)}}
+	}
+
+	extraneous, numDeletions := extraneousResources(ctx.ResourceMap, withoutFailedItemDirs(ctx, local))
+	if refused := exceedsMaxDelete(ctx, dest, numDeletions); refused != nil {
+		return nil, refused
+	}
+
+	deleted, failed := make([]string, 0), make([]Outcome, 0)
+	for _, resource := range extraneous {
+		if ctx.DryRun {
+			deleted = append(deleted, resource.Path)
+			continue
+		} else if ctx.Interrupted() {
+			break
+		}
+		ctx.Logger.Infof("deleting: %s\n", resource.Path)
+		if err := os.RemoveAll(resource.Path); err != nil {
+			ctx.Logger.Errorf("failed to delete %s, err: %s", resource.Path, err)
+			failed = append(failed, Outcome{Path: resource.Path, Reason: fmt.Sprintf("failed to delete, err: %s", err)})
+			continue
+		}
+		deleted = append(deleted, resource.Path)
+	}
+	return deleted, failed
+}
+
+func logDeletions(ctx *girder.Context, deleted []string) {
+	if len(deleted) == 0 {
+		return
+	}
+	ctx.Logger.Infof("deleted %d files/folders:", len(deleted))
+	for _, p := range deleted {
+		ctx.Logger.Info(p)
+	}
+}
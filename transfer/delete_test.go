@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_extraneousResources(t *testing.T) {
+	source := girder.ResourceMap{
+		"a":          {Path: "a", Type: "directory"},
+		"a/kept":     {Path: "a/kept", Type: "file"},
+		"became_dir": {Path: "became_dir", Type: "directory"},
+	}
+	dest := girder.ResourceMap{
+		"a":             {Path: "a", Type: "directory"},
+		"a/kept":        {Path: "a/kept", Type: "file"},
+		"a/removed":     {Path: "a/removed", Type: "file"},
+		"became_dir":    {Path: "became_dir", Type: "file"},
+		"gone":          {Path: "gone", Type: "directory"},
+		"gone/inner":    {Path: "gone/inner", Type: "directory"},
+		"gone/inner/x":  {Path: "gone/inner/x", Type: "file"},
+		"gone/top_file": {Path: "gone/top_file", Type: "file"},
+	}
+
+	got, numDeletions := extraneousResources(source, dest)
+
+	want := []string{"a/removed", "became_dir", "gone"}
+	if len(got) != len(want) {
+		t.Fatalf("extraneousResources() returned %d resources, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Path != want[i] {
+			t.Errorf("extraneousResources()[%d] = %s, want %s", i, got[i].Path, want[i])
+		}
+	}
+	if numDeletions != 6 {
+		t.Errorf("extraneousResources() counted %d deletions, want 6", numDeletions)
+	}
+}
+
+func Test_withoutPaths(t *testing.T) {
+	m := girder.ResourceMap{
+		"a":          {Path: "a", Type: "directory"},
+		"a/link":     {Path: "a/link", Type: "file"},
+		"a/linked":   {Path: "a/linked", Type: "directory"},
+		"a/linked/x": {Path: "a/linked/x", Type: "file"},
+		"b":          {Path: "b", Type: "file"},
+	}
+
+	got := withoutPaths(m, []string{"a/link", "b"})
+	if len(got) != 3 || got["a"] == nil || got["a/linked"] == nil || got["a/linked/x"] == nil {
+		t.Errorf("withoutPaths() = %v, want a, a/linked, and a/linked/x", got)
+	}
+}
+
+func Test_deleteLocalResourcesMaxDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	ctx := &girder.Context{Logger: logrus.New(), MaxDelete: 1, ResourceMap: make(girder.ResourceMap)}
+
+	// refusing to delete anything is a failure, so the sync doesn't appear to have mirrored
+	deleted, failed := deleteLocalResources(ctx, dir)
+	if len(deleted) != 0 || len(failed) != 1 || failed[0].Path != dir {
+		t.Errorf("deleteLocalResources() = %v, %v, want the refusal to delete as a failure", deleted, failed)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d files are left, want both", len(entries))
+	}
+}
@@ -1,94 +1,521 @@
 package transfer
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/danlamanna/rivet/filter"
 	"github.com/danlamanna/rivet/girder"
 
 	sync_ "sync"
 )
 
-func maybeDownloadItem(ctx *girder.Context, p *girder.PathAndResource) {
-	files := girder.ItemFiles(ctx, p.Resource.GirderID)
+const partialSuffix = ".rivetpart"
 
+// maybeCreateSymlink recreates a symbolic link preserved in girder, replacing whatever is
+// at the local path if it isn't already the same link.
+func maybeCreateSymlink(ctx *girder.Context, p *girder.PathAndResource) {
+	if target, err := os.Readlink(p.Path); err == nil && target == p.Resource.LinkTarget {
+		p.Resource.Action, p.Resource.ActionReason = "skip", "unchanged"
+		return
+	}
+
+	p.Resource.Action, p.Resource.ActionReason = "link", p.Resource.LinkTarget
+	if ctx.DryRun {
+		return
+	}
+	if err := os.MkdirAll(path.Dir(p.Path), os.ModePerm); err != nil {
+		ctx.Logger.Errorf("failed to create local directory %s, err: %s", path.Dir(p.Path), err)
+		p.Resource.SkipSync, p.Resource.SkipReason = true, err.Error()
+		return
+	}
+	if _, err := os.Lstat(p.Path); err == nil {
+		if err := os.RemoveAll(p.Path); err != nil {
+			ctx.Logger.Errorf("failed to replace %s, err: %s", p.Path, err)
+			p.Resource.SkipSync, p.Resource.SkipReason = true, err.Error()
+			return
+		}
+	}
+	ctx.Logger.Infof("linking %s -> %s\n", p.Path, p.Resource.LinkTarget)
+	if err := os.Symlink(p.Resource.LinkTarget, p.Path); err != nil {
+		ctx.Logger.Errorf("failed to create symbolic link %s, err: %s", p.Path, err)
+		p.Resource.SkipSync, p.Resource.SkipReason = true, err.Error()
+	}
+}
+
+// checkLinkTarget returns why a symbolic link at p, within the local destination root,
+// shouldn't be created pointing at target, which is when target is absolute or outside
+// of root.
+func checkLinkTarget(root string, p string, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("its target %s is an absolute path", target)
+	}
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(p), target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("its target %s is outside of %s", target, root)
+	}
+	return nil
+}
+
+// isPreservedLink reports whether p is a symbolic link which is being preserved, in which
+// case it's replaced rather than followed when girder has a folder there instead.
+func isPreservedLink(ctx *girder.Context, p string) bool {
+	st, err := os.Lstat(p)
+	return err == nil && st.Mode()&os.ModeSymlink != 0 && ctx.Symlinks == SymlinksPreserve
+}
+
+// recordDownload remembers that the local file is in sync with the remote file.
+func recordDownload(ctx *girder.Context, cache *syncCache, p *girder.PathAndResource, remote girder.GirderFile) {
+	st, err := os.Stat(p.Path)
+	if err != nil {
+		return
+	}
+	cache.recordFile(p.Path, &syncedFile{
+		Size:          st.Size(),
+		ModTime:       st.ModTime(),
+		ItemID:        p.Resource.GirderID,
+		FileID:        remote.ID,
+		Sha512:        remote.Sha512,
+		RemoteUpdated: p.Resource.RemoteUpdated,
+	})
+}
+
+// isUnchangedDownload reports whether neither the item nor the local file have changed
+// since the item was last downloaded, in which case its files don't need to be listed.
+func isUnchangedDownload(cache *syncCache, p *girder.PathAndResource) (*syncedFile, bool) {
+	if p.Resource.RemoteUpdated == "" {
+		return nil, false
+	}
+	st, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, false
+	}
+	synced, ok := cache.unchangedFile(p.Path, st.Size(), st.ModTime())
+	if !ok || synced.ItemID != p.Resource.GirderID || synced.RemoteUpdated != p.Resource.RemoteUpdated || synced.Size != p.Resource.Size {
+		return nil, false
+	}
+	return synced, true
+}
+
+func maybeDownloadItem(ctx *girder.Context, cache *syncCache, p *girder.PathAndResource) {
+	if p.Resource.LinkTarget != "" {
+		maybeCreateSymlink(ctx, p)
+		return
+	}
+
+	if synced, ok := isUnchangedDownload(cache, p); ok {
+		p.Resource.Action, p.Resource.ActionReason = "skip", "unchanged since last sync"
+		ctx.Logger.Debugf("skipping (unchanged since last sync) %s\n", p.Path)
+		removeStalePartial(ctx, p.Path)
+		cache.recordFile(p.Path, synced)
+		return
+	}
+
+	files, err := girder.ItemFiles(ctx, p.Resource.GirderID)
+	if err != nil {
+		ctx.Logger.Errorf("failed to list the files of %s, err: %s", p.Path, err)
+		p.Resource.SkipSync, p.Resource.SkipReason = true, fmt.Sprintf("failed to list the files of the item, err: %s", err)
+		return
+	}
+
+	if ctx.ItemLayout == ItemLayoutDirectory && !isPlainItem(p, files) {
+		downloadItemDir(ctx, p, files)
+		return
+	}
 	if len(files) == 0 {
+		p.Resource.Action, p.Resource.ActionReason = "skip", "item has 0 files"
 		ctx.Logger.Debugf("skipping sync of item, 0 files found")
 		return
 	} else if len(files) > 1 {
+		p.Resource.Action, p.Resource.ActionReason = "skip", "item has > 1 file"
 		ctx.Logger.Warnf("skipping sync of item, > 1 files found")
 		return
 	}
-	err := os.MkdirAll(path.Dir(p.Path), os.ModePerm)
-	if err != nil {
-		ctx.Logger.Errorf("failed to create local directory %s, err: %s", path.Dir(p.Path), err)
+	if downloadContents(ctx, p.Resource, files[0]) {
+		recordDownload(ctx, cache, p, files[0])
 	}
-	st, err := os.Stat(p.Path)
+}
+
+// downloadContents makes the local file of resource the same as the remote file,
+// reporting whether they're now in sync.
+func downloadContents(ctx *girder.Context, resource *girder.Resource, remote girder.GirderFile) bool {
+	if !ctx.DryRun {
+		err := os.MkdirAll(path.Dir(resource.Path), os.ModePerm)
+		if err != nil {
+			ctx.Logger.Errorf("failed to create local directory %s, err: %s", path.Dir(resource.Path), err)
+		}
+	}
+	st, err := os.Stat(resource.Path)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			ctx.Logger.Errorf("failed to stat %s, err: %s", p.Path, err)
-			return
+			ctx.Logger.Errorf("failed to stat %s, err: %s", resource.Path, err)
+			resource.SkipSync, resource.SkipReason = true, err.Error()
+			return false
 		}
 	}
-	if st != nil && st.Size() == files[0].Size {
-		ctx.Logger.Debugf("skipping (same size) %s\n", p.Path)
+	if st != nil {
+		differ, reason, err := filesDiffer(ctx, resource.Path, st, remote, false)
+		if err != nil {
+			ctx.Logger.Error(err)
+			resource.SkipSync, resource.SkipReason = true, err.Error()
+			return false
+		} else if !differ {
+			resource.Action, resource.ActionReason = "skip", "unchanged"
+			ctx.Logger.Debugf("skipping (unchanged) %s\n", resource.Path)
+			removeStalePartial(ctx, resource.Path)
+			return true
+		}
+		resource.Action, resource.ActionReason = "replace", reason
+		ctx.Logger.Debugf("%s for %s\n", reason, resource.Path)
+	} else {
+		resource.Action, resource.ActionReason = "download", "new file"
+	}
+	if ctx.DryRun {
+		return false
+	}
+	ctx.Logger.Infof("downloading %s -> %s\n", resource.GirderID, resource.Path)
+	if err := downloadFile(ctx, remote, resource.Path); err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		ctx.Logger.Errorf("failed to download file %s, err: %s", resource.Path, err)
+		return false
+	}
+
+	// keep the local modification time in step with the remote so mtime comparisons are stable
+	if ctx.Compare == CompareMtime {
+		if remoteTime, err := remote.ModTime(); err == nil {
+			os.Chtimes(resource.Path, remoteTime, remoteTime)
+		}
+	}
+	return true
+}
+
+// partialPath returns where the contents of dest are written while downloading, so an
+// interrupted download can be resumed and never leaves dest truncated.
+func partialPath(dest string) string {
+	return path.Join(path.Dir(dest), "."+path.Base(dest)+partialSuffix)
+}
+
+// isPartialDownload reports whether p is the temporary file of an unfinished download.
+func isPartialDownload(p string) bool {
+	base := filepath.Base(p)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, partialSuffix)
+}
+
+// partialDest returns the destination of p, the temporary file of an unfinished download.
+func partialDest(p string) string {
+	base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "."), partialSuffix)
+	return filepath.Join(filepath.Dir(p), base)
+}
+
+// removeStalePartial removes what's left of an unfinished download of dest, which is
+// already in sync so will never be resumed.
+func removeStalePartial(ctx *girder.Context, dest string) {
+	if ctx.DryRun {
 		return
 	}
-	out, err := os.Create(p.Path)
+	tmpPath := partialPath(dest)
+	if err := os.Remove(tmpPath); err == nil {
+		ctx.Logger.Debugf("removed unfinished download %s of unchanged %s", tmpPath, dest)
+	} else if !os.IsNotExist(err) {
+		ctx.Logger.Warnf("failed to remove unfinished download %s, err: %s", tmpPath, err)
+	}
+}
+
+// downloadFile downloads remote into a temporary file next to dest, continuing where a
+// previous attempt left off, and once its size and checksum are verified moves it into
+// place over dest.
+func downloadFile(ctx *girder.Context, remote girder.GirderFile, dest string) error {
+	tmpPath := partialPath(dest)
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		ctx.Logger.Errorf("failed to create local file %s, err: %s", p.Path, err)
+		return err
 	}
 	defer out.Close()
-	ctx.Logger.Infof("downloading %s -> %s\n", p.Resource.GirderID, p.Path)
-	_, err = girder.GetDownload(ctx, fmt.Sprintf("item/%s/download", p.Resource.GirderID), out)
+
+	offset, err := out.Seek(0, io.SeekEnd)
 	if err != nil {
-		ctx.Logger.Errorf("failed to download file %s, err: %s", p.Path, err)
+		return err
+	}
+	if offset >= remote.Size {
+		// a leftover from a different version of the file
+		offset = 0
+	}
+	if offset > 0 {
+		ctx.Logger.Infof("resuming download of %s at %d/%d bytes\n", dest, offset, remote.Size)
+	}
+	tracker(ctx).Start(dest, remote.Size, offset)
+	defer tracker(ctx).End(dest)
+
+	for {
+		if err := out.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := out.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		_, err = girder.GetDownload(ctx, fmt.Sprintf("file/%s/download", remote.ID), offset, progressWriter{out, dest, tracker(ctx)})
+		if err != nil && ctx.Interrupted() {
+			// keep what was received so it can be resumed, unless that's nothing
+			if st, statErr := out.Stat(); statErr == nil && st.Size() == 0 {
+				out.Close()
+				os.Remove(tmpPath)
+			}
+			return err
+		} else if err == girder.ErrRangeIgnored {
+			ctx.Logger.Debugf("unable to resume download of %s, starting over", dest)
+			offset = 0
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		verifyErr := verifyDownload(tmpPath, remote)
+		if verifyErr != nil && offset > 0 {
+			// the partial file may have been from an older version, so try once more from scratch
+			ctx.Logger.Debugf("resumed download of %s is corrupt, starting over. err: %s", dest, verifyErr)
+			offset = 0
+			continue
+		} else if verifyErr != nil {
+			os.Remove(tmpPath)
+			return verifyErr
+		}
+		break
 	}
 
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dest)
 }
 
-func downloadFolder(ctx *girder.Context, src girder.GirderID, dest string, itemsToDownload chan *girder.PathAndResource) {
+// verifyDownload checks the downloaded file matches the size and, if girder knows it, the
+// checksum of the remote file.
+func verifyDownload(tmpPath string, remote girder.GirderFile) error {
+	st, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	} else if st.Size() != remote.Size {
+		return fmt.Errorf("downloaded %d bytes but expected %d", st.Size(), remote.Size)
+	}
+
+	if remote.Sha512 != "" {
+		localHash, err := hashFile(tmpPath)
+		if err != nil {
+			return err
+		} else if localHash != remote.Sha512 {
+			return errors.New("checksum of downloaded file doesn't match")
+		}
+	}
+	return nil
+}
+
+// isExcluded reports whether relPath, relative to the root of the sync, is excluded.
+func isExcluded(ctx *girder.Context, relPath string, isDir bool) bool {
+	if ctx.Filter.Excluded(filepath.ToSlash(relPath), isDir) {
+		ctx.Logger.Debugf("excluding %s", relPath)
+		ctx.NumExcluded++
+		return true
+	}
+	return false
+}
+
+// loadRemoteIgnoreFile adds the patterns of an ignore file stored in girder, which applies
+// to relDir.
+func loadRemoteIgnoreFile(ctx *girder.Context, itemID girder.GirderID, relDir string) {
+	if ctx.Filter == nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, err := girder.GetDownload(ctx, fmt.Sprintf("item/%s/download", itemID), 0, buf)
+	if err != nil {
+		ctx.Logger.Warnf("failed to download %s, err: %s", path.Join(relDir, filter.IgnoreFileName), err)
+		return
+	}
+	if err := ctx.Filter.AddIgnoreFile(relDir, buf); err != nil {
+		ctx.Logger.Warnf("failed to parse %s, err: %s", path.Join(relDir, filter.IgnoreFileName), err)
+	}
+}
+
+func downloadFolder(ctx *girder.Context, srcType string, src girder.GirderID, root string, dest string, itemsToDownload chan *girder.PathAndResource) error {
+	if ctx.Interrupted() {
+		return ctx.Ctx.Err()
+	}
+	items, err := girder.Items(ctx, srcType, src)
+	if err != nil {
+		ctx.Logger.Errorf("failed to list items of %s, err: %s", dest, err)
+		markFailed(ctx, dest, fmt.Sprintf("failed to list items, err: %s", err))
+		return err
+	}
+
+	relDir, _ := filepath.Rel(root, dest)
+	for _, item := range items {
+		if item.Name == filter.IgnoreFileName {
+			loadRemoteIgnoreFile(ctx, item.ID, filepath.ToSlash(relDir))
+		}
+	}
 
 	// queue items for download
-	for _, item := range girder.Items(ctx, src) {
+	for _, item := range items {
+		if isExcluded(ctx, path.Join(relDir, item.Name), false) {
+			continue
+		}
 		p := new(girder.PathAndResource)
 		p.Path = path.Join(dest, item.Name)
 		p.Resource = new(girder.Resource)
+		p.Resource.Path = p.Path
+		p.Resource.Type = "file"
 		p.Resource.GirderID = item.ID
+		p.Resource.GirderType = "item"
+		p.Resource.Size = item.Size
+		p.Resource.RemoteUpdated = item.Updated
+		ctx.ResourceMap[p.Path] = p.Resource
+		if target, ok := item.Meta[symlinkMetaKey].(string); ok && ctx.Symlinks == SymlinksPreserve {
+			if err := checkLinkTarget(root, p.Path, target); err != nil {
+				p.Resource.Action, p.Resource.ActionReason = "skip", err.Error()
+				ctx.Logger.Warnf("skipping symbolic link %s, %s", p.Path, err)
+				emitOutcome(ctx, p.Resource)
+				continue
+			}
+			p.Resource.LinkTarget = target
+		}
+		downloadSidecar(ctx, p.Path, "item", item.ID, item.Meta)
+		tracker(ctx).Plan(p.Resource.Size)
 		itemsToDownload <- p
 	}
 
+	folders, err := girder.Folders(ctx, srcType, src)
+	if err != nil {
+		ctx.Logger.Errorf("failed to list folders of %s, err: %s", dest, err)
+		markFailed(ctx, dest, fmt.Sprintf("failed to list folders, err: %s", err))
+		return err
+	}
+
 	// recurse on folders
-	for _, folder := range girder.Folders(ctx, src) {
+	var failed error
+	for _, folder := range folders {
+		folderPath := path.Join(dest, folder.Name)
+		if isExcluded(ctx, path.Join(relDir, folder.Name), true) {
+			continue
+		}
+		folderResource := &girder.Resource{Path: folderPath, Type: "directory", GirderID: folder.ID, GirderType: "folder"}
+		ctx.ResourceMap[folderPath] = folderResource
+
+		// a link where there's now a folder, preserved by an earlier sync, is replaced rather
+		// than followed, so the folder's contents are never written wherever it points
+		replaceLink := isPreservedLink(ctx, folderPath)
+		if replaceLink {
+			folderResource.Action, folderResource.ActionReason = "create directory", "replacing symbolic link"
+		} else if st, err := os.Stat(folderPath); err == nil && st.IsDir() {
+			folderResource.Action, folderResource.ActionReason = "skip", "directory exists"
+		} else {
+			folderResource.Action = "create directory"
+		}
+
 		// make folder (empty dir case)
-		err := os.MkdirAll(path.Join(dest, folder.Name), os.ModePerm)
-		if err != nil {
-			ctx.Logger.Errorf("failed to create local directory %s, err: %s", path.Join(dest, folder.Name), err)
+		if !ctx.DryRun {
+			var err error
+			if replaceLink {
+				err = os.Remove(folderPath)
+			}
+			if err == nil {
+				err = os.MkdirAll(folderPath, os.ModePerm)
+			}
+			if err != nil {
+				ctx.Logger.Errorf("failed to create local directory %s, err: %s", folderPath, err)
+				folderResource.SkipSync, folderResource.SkipReason = true, err.Error()
+			} else if folderResource.Action == "create directory" {
+				emit(ctx, Event{Event: "folder_created", Path: folderPath, GirderID: folder.ID})
+			}
+		}
+		if replaceLink && folderResource.SkipSync {
+			continue
+		}
+		downloadSidecar(ctx, folderPath, "folder", folder.ID, folder.Meta)
+		if err := downloadFolder(ctx, "folder", folder.ID, root, folderPath, itemsToDownload); err != nil {
+			failed = err
 		}
-		downloadFolder(ctx, folder.ID, path.Join(dest, folder.Name), itemsToDownload)
 	}
+	return failed
 }
 
-func Download(ctx *girder.Context, src girder.GirderID, dest string) {
+// markFailed records that the resource at p couldn't be synced, if it's known.
+func markFailed(ctx *girder.Context, p string, reason string) {
+	if resource, ok := ctx.ResourceMap[p]; ok && !resource.SkipSync {
+		resource.SkipSync, resource.SkipReason = true, reason
+	}
+}
+
+// Download syncs the girder folder, collection, or user src to the local directory dest,
+// returning what happened to each path.
+func Download(ctx *girder.Context, src girder.GirderID, dest string) *Result {
 	itemsToDownload := make(chan *girder.PathAndResource)
 	var wg sync_.WaitGroup
 
-	for w := 1; w <= 10; w++ {
+	dest = path.Clean(dest)
+	cache := loadSyncCache(ctx, dest, src, "download")
+
+	for w := 1; w <= numWorkers(ctx.Workers, DefaultWorkers); w++ {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for pathAndResource := range itemsToDownload {
-				wg.Add(1)
-				maybeDownloadItem(ctx, pathAndResource)
-				wg.Done()
+				if !skipIfInterrupted(ctx, pathAndResource.Resource) {
+					maybeDownloadItem(ctx, cache, pathAndResource)
+				}
+				emitOutcome(ctx, pathAndResource.Resource)
+				tracker(ctx).Finish(pathAndResource.Resource)
 			}
 		}()
 	}
 
-	downloadFolder(ctx, src, dest, itemsToDownload)
+	startProgress(ctx, "downloading")
+	listErr := downloadFolder(ctx, ctx.RootParentType(), src, dest, dest, itemsToDownload)
+	if ctx.Events != nil {
+		numDirs, numFiles := 0, 0
+		for _, resource := range ctx.ResourceMap {
+			if resource.Type == "directory" {
+				numDirs++
+			} else {
+				numFiles++
+			}
+		}
+		emit(ctx, Event{Event: "scan_complete", Dirs: numDirs, Files: numFiles, Excluded: ctx.NumExcluded})
+	}
 
-	wg.Wait()
 	close(itemsToDownload)
+	wg.Wait()
+	stopProgress(ctx)
+	addItemDirs(ctx)
+
+	var deleted []string
+	var deleteFailures []Outcome
+	if ctx.Delete && !ctx.Interrupted() {
+		if listErr != nil {
+			ctx.Logger.Warn("skipping deletion of local files since the remote could not be fully listed")
+		} else {
+			deleted, deleteFailures = deleteLocalResources(ctx, dest)
+		}
+	}
 
-	fmt.Println("done")
-	return
+	result := newResult(ctx, deleted)
+	result.Failed = append(result.Failed, deleteFailures...)
+	if listErr != nil && ctx.ResourceMap[dest] == nil && !ctx.Interrupted() {
+		// folders which couldn't be listed are recorded as failures, but the root isn't a resource
+		result.Failed = append([]Outcome{{Path: dest, Reason: listErr.Error()}}, result.Failed...)
+	}
+	if ctx.DryRun {
+		printPlan(ctx, deleted)
+	} else {
+		cache.save(ctx)
+		printSummary(ctx, result)
+	}
+	emitSummary(ctx, result)
+	return result
 }
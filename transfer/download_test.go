@@ -0,0 +1,247 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+// downloadServer serves contents as the download of a file, honoring Range headers if
+// ranges is set, and returns a function reporting the Range headers it was sent.
+func downloadServer(contents []byte, ranges bool) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	requested := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested = append(requested, r.Header.Get("Range"))
+		lock.Unlock()
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil && ranges {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(contents[offset:])
+			return
+		}
+		w.Write(contents)
+	}))
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return requested
+	}
+}
+
+func downloadContext(url string) *girder.Context {
+	return &girder.Context{URL: url, Logger: logrus.New()}
+}
+
+func remoteFile(contents []byte) girder.GirderFile {
+	sum := sha512.Sum512(contents)
+	return girder.GirderFile{ID: "file", Size: int64(len(contents)), Sha512: hex.EncodeToString(sum[:])}
+}
+
+func Test_downloadFile(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 100)
+	tests := []struct {
+		name    string
+		ranges  bool
+		partial []byte
+		want    []string
+	}{
+		{"resumes unfinished download", true, contents[:300], []string{"bytes=300-"}},
+		{"starts over when range is ignored", false, contents[:300], []string{"bytes=300-", ""}},
+		{"starts over when resumed download is corrupt", true, []byte("corrupt"), []string{"bytes=7-", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rivet")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			dest := filepath.Join(dir, "f")
+			ioutil.WriteFile(dest, []byte("old contents"), 0644)
+			ioutil.WriteFile(partialPath(dest), tt.partial, 0644)
+
+			server, requested := downloadServer(contents, tt.ranges)
+			defer server.Close()
+			if err := downloadFile(downloadContext(server.URL), remoteFile(contents), dest); err != nil {
+				t.Fatalf("downloadFile() failed, err: %s", err)
+			}
+			if got := requested(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("downloadFile() requested ranges %q, want %q", got, tt.want)
+			}
+			if got, _ := ioutil.ReadFile(dest); !bytes.Equal(got, contents) {
+				t.Errorf("downloaded file has different contents")
+			}
+			if _, err := os.Stat(partialPath(dest)); !os.IsNotExist(err) {
+				t.Errorf("unfinished download was left behind")
+			}
+		})
+	}
+}
+
+func Test_downloadFileCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "f")
+	ioutil.WriteFile(dest, []byte("old contents"), 0644)
+
+	// the file is only replaced once what was downloaded matches the checksum
+	server, _ := downloadServer([]byte("new contents"), true)
+	defer server.Close()
+	if err := downloadFile(downloadContext(server.URL), remoteFile([]byte("new content!")), dest); err == nil {
+		t.Errorf("downloadFile() succeeded despite the checksum differing")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "old contents" {
+		t.Errorf("file was replaced by a download which failed verification, got %q", got)
+	}
+	if _, err := os.Stat(partialPath(dest)); !os.IsNotExist(err) {
+		t.Errorf("corrupt download was left behind")
+	}
+}
+
+func Test_stalePartialDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := []byte("contents")
+	unchanged, deleted, pending := filepath.Join(dir, "unchanged"), filepath.Join(dir, "deleted"), filepath.Join(dir, "pending")
+	ioutil.WriteFile(unchanged, contents, 0644)
+	for _, dest := range []string{unchanged, deleted, pending} {
+		ioutil.WriteFile(partialPath(dest), contents[:4], 0644)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote := remoteFile(contents)
+		fmt.Fprintf(w, `[{"_id": "%s", "size": %d, "sha512": "%s"}]`, remote.ID, remote.Size, remote.Sha512)
+	}))
+	defer server.Close()
+	ctx := downloadContext(server.URL)
+	ctx.ResourceMap = girder.ResourceMap{
+		unchanged: {Path: unchanged, Type: "file", GirderID: "item"},
+		pending:   {Path: pending, Type: "file", GirderID: "item"},
+	}
+
+	// a download of a file which is already in sync is never resumed
+	cache := &syncCache{
+		previous: syncCacheContents{Folders: make(map[string]girder.GirderID), Files: make(map[string]*syncedFile)},
+		current:  syncCacheContents{Folders: make(map[string]girder.GirderID), Files: make(map[string]*syncedFile)},
+	}
+	maybeDownloadItem(ctx, cache, &girder.PathAndResource{Path: unchanged, Resource: ctx.ResourceMap[unchanged]})
+	if action := ctx.ResourceMap[unchanged].Action; action != "skip" {
+		t.Fatalf("unchanged file was planned to %s, want skip", action)
+	}
+	if _, err := os.Stat(partialPath(unchanged)); !os.IsNotExist(err) {
+		t.Errorf("unfinished download of an unchanged file was kept")
+	}
+
+	// nor is a download of a file which was deleted from girder
+	got, failed := deleteLocalResources(ctx, dir)
+	if len(got) != 1 || len(failed) != 0 || got[0] != partialPath(deleted) {
+		t.Errorf("deleteLocalResources() = %v, want only the download of the deleted file", got)
+	}
+	if _, err := os.Stat(partialPath(pending)); err != nil {
+		t.Errorf("unfinished download of a file still in girder was removed")
+	}
+}
+
+func Test_partialDest(t *testing.T) {
+	for _, dest := range []string{"f", "d/f.txt", "d/.hidden"} {
+		if got := partialDest(partialPath(dest)); got != dest {
+			t.Errorf("partialDest(%s) = %s, want %s", partialPath(dest), got, dest)
+		}
+	}
+}
+
+func Test_checkLinkTarget(t *testing.T) {
+	tests := []struct {
+		p       string
+		target  string
+		wantErr bool
+	}{
+		{"/dest/a/link", "file", false},
+		{"/dest/a/link", "../b/file", false},
+		{"/dest/a/link", "..", false},
+		{"/dest/a/link", "../..", true},
+		{"/dest/link", "../dest2/file", true},
+		{"/dest/a/link", "/etc/passwd", true},
+	}
+	for _, tt := range tests {
+		if err := checkLinkTarget("/dest", tt.p, tt.target); (err != nil) != tt.wantErr {
+			t.Errorf("checkLinkTarget(%s -> %s) = %v, want error %v", tt.p, tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_downloadPreservedLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest, outside := filepath.Join(dir, "dest"), filepath.Join(dir, "outside")
+	os.MkdirAll(dest, 0755)
+	os.MkdirAll(outside, 0755)
+	// a link preserved by an earlier sync, where girder now has a folder
+	os.Symlink(outside, filepath.Join(dest, "linked"))
+
+	listings := map[string]string{
+		"item?folderId=root": `[
+			{"_id": "abs", "name": "abs", "meta": {"rivet_symlink_target": "/etc/passwd"}},
+			{"_id": "escapes", "name": "escapes", "meta": {"rivet_symlink_target": "../outside"}},
+			{"_id": "within", "name": "within", "meta": {"rivet_symlink_target": "linked"}}
+		]`,
+		"folder?parentType=folder&parentId=root": `[{"_id": "linked", "name": "linked"}]`,
+		"item?folderId=linked":                   `[{"_id": "nested", "name": "nested", "meta": {"rivet_symlink_target": "../within"}}]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimPrefix(r.URL.String(), "/")
+		if listing, ok := listings[strings.Split(query, "&offset=")[0]]; ok && strings.Contains(query, "offset=0&") {
+			fmt.Fprint(w, listing)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+	ctx := downloadContext(server.URL)
+	ctx.ResourceMap = make(girder.ResourceMap)
+	ctx.Symlinks = SymlinksPreserve
+
+	Download(ctx, "root", dest)
+
+	// links pointing outside of the destination aren't created
+	for _, name := range []string{"abs", "escapes"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("symbolic link %s pointing outside of the destination was created", name)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "within")); err != nil || target != "linked" {
+		t.Errorf("symbolic link within = %s, %v, want linked", target, err)
+	}
+	// and nothing is written through a link which is now a folder
+	if st, err := os.Lstat(filepath.Join(dest, "linked")); err != nil || !st.IsDir() {
+		t.Errorf("symbolic link linked wasn't replaced by a directory, err: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("%d files were written through a symbolic link", len(entries))
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "linked", "nested")); err != nil || target != "../within" {
+		t.Errorf("symbolic link linked/nested = %s, %v, want ../within", target, err)
+	}
+}
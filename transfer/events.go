@@ -0,0 +1,103 @@
+package transfer
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// OutputText logs the progress of a sync for people to read, OutputJSON additionally
+// writes an event for each step of the sync to stdout.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Event is a single step of a sync, written as a line of JSON. Fields which don't
+// apply to an event are omitted.
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	Path     string          `json:"path,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	GirderID girder.GirderID `json:"girder_id,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+
+	// Size and Offset are in bytes, Chunk counts from 1 up to Chunks
+	Size   int64 `json:"size,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+	Chunk  int64 `json:"chunk,omitempty"`
+	Chunks int64 `json:"chunks,omitempty"`
+
+	Dirs     int `json:"dirs,omitempty"`
+	Files    int `json:"files,omitempty"`
+	Excluded int `json:"excluded,omitempty"`
+}
+
+// summaryEvent is the final event of a sync, containing its entire result.
+type summaryEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	*Result
+}
+
+func writeEvent(ctx *girder.Context, event interface{}) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		ctx.Logger.Errorf("failed to encode event, err: %s", err)
+		return
+	}
+	ctx.Events.WriteLine(line)
+}
+
+// emit writes event if events were requested, filling in when it happened.
+func emit(ctx *girder.Context, event Event) {
+	if ctx.Events == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	writeEvent(ctx, event)
+}
+
+// emitOutcome writes a file_skipped or file_failed event for resource once it has been
+// skipped or has failed. Resources which were synced don't have an outcome event, the
+// events of the steps which synced them having been emitted instead.
+func emitOutcome(ctx *girder.Context, resource *girder.Resource) {
+	if ctx.Events == nil {
+		return
+	}
+	event := Event{Path: resource.Path, Type: resource.Type, GirderID: resource.GirderID}
+	if wasInterrupted(ctx, resource) {
+		event.Event, event.Reason = "file_skipped", interruptedReason
+	} else if resource.SkipSync {
+		event.Event, event.Reason = "file_failed", resource.SkipReason
+	} else if resource.Action == "skip" {
+		event.Event, event.Reason = "file_skipped", resource.ActionReason
+	} else {
+		return
+	}
+
+	if ctx.Events.Report(resource.Path) {
+		emit(ctx, event)
+	}
+}
+
+// emitSummary writes the outcome of every resource which hasn't had one emitted yet,
+// followed by the summary of the sync, which ends it.
+func emitSummary(ctx *girder.Context, result *Result) {
+	if ctx.Events == nil {
+		return
+	}
+	paths := make([]string, 0, len(ctx.ResourceMap))
+	for p := range ctx.ResourceMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		emitOutcome(ctx, ctx.ResourceMap[p])
+	}
+	writeEvent(ctx, summaryEvent{Event: "summary", Time: time.Now().UTC(), Result: result})
+}
@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+func Test_emitSummary(t *testing.T) {
+	var out bytes.Buffer
+	ctx := &girder.Context{Events: girder.NewEventStream(&out), ResourceMap: girder.ResourceMap{
+		"events/new":    {Path: "events/new", Type: "file", Action: "upload"},
+		"events/same":   {Path: "events/same", Type: "file", Action: "skip", ActionReason: "unchanged"},
+		"events/broken": {Path: "events/broken", Type: "file", SkipSync: true, SkipReason: "permission denied"},
+	}}
+
+	// outcomes already emitted during the sync aren't repeated
+	emitOutcome(ctx, ctx.ResourceMap["events/same"])
+	emitSummary(ctx, newResult(ctx, nil))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{"file_skipped events/same unchanged", "file_failed events/broken permission denied", "summary  "}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(lines), len(want), out.String())
+	}
+	for i, line := range lines {
+		event := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %d isn't JSON: %s", i, line)
+		}
+		path, _ := event["path"].(string)
+		reason, _ := event["reason"].(string)
+		if got := event["event"].(string) + " " + path + " " + reason; got != want[i] {
+			t.Errorf("event %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	summary := make(map[string]interface{})
+	json.Unmarshal([]byte(lines[2]), &summary)
+	if failed := summary["failed"].([]interface{}); len(failed) != 1 {
+		t.Errorf("summary failed = %v, want events/broken", failed)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	var out bytes.Buffer
+	ctx := &girder.Context{Events: girder.NewEventStream(&out)}
+	if result := Abort(ctx, errors.New("destination does not exist")); result.OK() {
+		t.Errorf("OK() = true for a sync which couldn't be started")
+	}
+
+	summary := make(map[string]interface{})
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("event isn't JSON: %s", out.String())
+	}
+	if summary["event"] != "summary" || summary["error"] != "destination does not exist" {
+		t.Errorf("Abort() emitted %s, want a summary with the error", out.String())
+	}
+}
@@ -0,0 +1,30 @@
+package transfer
+
+import (
+	"context"
+	"strings"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// interruptedReason is why resources weren't synced once the sync was interrupted.
+const interruptedReason = "interrupted"
+
+// skipIfInterrupted marks resource as not synced if the sync has been interrupted,
+// reporting whether it was.
+func skipIfInterrupted(ctx *girder.Context, resource *girder.Resource) bool {
+	if !ctx.Interrupted() {
+		return false
+	}
+	resource.SkipSync, resource.SkipReason = true, interruptedReason
+	return true
+}
+
+// wasInterrupted reports whether resource wasn't synced because the sync was interrupted,
+// either before it was started or by its requests being aborted.
+func wasInterrupted(ctx *girder.Context, resource *girder.Resource) bool {
+	if !ctx.Interrupted() || !resource.SkipSync {
+		return false
+	}
+	return resource.SkipReason == interruptedReason || strings.HasSuffix(resource.SkipReason, context.Canceled.Error())
+}
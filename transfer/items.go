@@ -0,0 +1,183 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+const (
+	ItemLayoutSkip      = "skip"
+	ItemLayoutDirectory = "directory"
+)
+
+// itemDirSuffix marks a local directory as a girder item whose files are the files
+// within it, rather than a folder.
+const itemDirSuffix = ".item"
+
+func isItemDir(p string) bool {
+	base := path.Base(p)
+	return strings.HasSuffix(base, itemDirSuffix) && base != itemDirSuffix
+}
+
+// itemDirName returns the name of the girder item synced with the item directory p.
+func itemDirName(p string) string {
+	return strings.TrimSuffix(path.Base(p), itemDirSuffix)
+}
+
+// inItemDir reports whether resource is a file within an item directory.
+func inItemDir(ctx *girder.Context, resource *girder.Resource) bool {
+	parent := ctx.ResourceMap.Parent(resource)
+	return parent != nil && parent.Type == "item"
+}
+
+// isPlainItem reports whether an item can be synced as a single local file, which is
+// when it has one file with the same name as the item. Anything else is synced as an
+// item directory, so uploading it again recreates the same files.
+func isPlainItem(p *girder.PathAndResource, files []girder.GirderFile) bool {
+	return len(files) == 1 && files[0].Name == path.Base(p.Path)
+}
+
+// createItemDir creates the item synced with an item directory within parentID, or
+// during a dry run finds whether it exists. The mutex guards the resource map.
+func createItemDir(ctx *girder.Context, mutex *sync.Mutex, cache *syncCache, parentID girder.GirderID, resource *girder.Resource) {
+	if id, ok := cache.folder(resource.Path); ok {
+		mutex.Lock()
+		resource.GirderID, resource.GirderType = id, "item"
+		resource.Action, resource.ActionReason = "skip", "unchanged since last sync"
+		mutex.Unlock()
+		cache.recordFolder(resource.Path, id)
+		return
+	}
+
+	itemID, created, err := girder.GetOrCreateItem(ctx, parentID, itemDirName(resource.Path))
+	mutex.Lock()
+	defer mutex.Unlock()
+	resource.GirderType = "item"
+	if err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		ctx.Logger.Error(err)
+		return
+	}
+	resource.GirderID = itemID
+	if itemID == "" {
+		resource.Action = "create item"
+		return
+	} else if ctx.DryRun {
+		resource.Action, resource.ActionReason = "skip", "item exists"
+	} else if created {
+		emit(ctx, Event{Event: "item_created", Path: resource.Path, GirderID: itemID})
+	}
+	cache.recordFolder(resource.Path, itemID)
+}
+
+// downloadItemDir downloads the files of an item into an item directory, recording them
+// as the contents of the item's resource.
+func downloadItemDir(ctx *girder.Context, p *girder.PathAndResource, files []girder.GirderFile) {
+	dir := p.Path + itemDirSuffix
+	p.Resource.Action, p.Resource.ActionReason = "sync item", fmt.Sprintf("%d files into %s", len(files), dir)
+	p.Resource.Contents = make([]*girder.Resource, 0, len(files))
+
+	if !ctx.DryRun {
+		if isPreservedLink(ctx, dir) {
+			if err := os.Remove(dir); err != nil {
+				p.Resource.SkipSync, p.Resource.SkipReason = true, err.Error()
+				ctx.Logger.Errorf("failed to replace symbolic link %s, err: %s", dir, err)
+				return
+			}
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			p.Resource.SkipSync, p.Resource.SkipReason = true, err.Error()
+			ctx.Logger.Errorf("failed to create local directory %s, err: %s", dir, err)
+			return
+		}
+	}
+	for _, file := range files {
+		resource := &girder.Resource{
+			Path:       path.Join(dir, file.Name),
+			Type:       "file",
+			Size:       file.Size,
+			GirderID:   file.ID,
+			GirderType: "file",
+		}
+		p.Resource.Contents = append(p.Resource.Contents, resource)
+		downloadContents(ctx, resource, file)
+	}
+}
+
+// addItemDirs adds the item directories created while downloading, along with their
+// files, to the resource map so they're known to exist in girder.
+func addItemDirs(ctx *girder.Context) {
+	itemDirs := make([]*girder.Resource, 0)
+	for _, resource := range ctx.ResourceMap {
+		if resource.Contents != nil {
+			itemDirs = append(itemDirs, resource)
+		}
+	}
+	for _, item := range itemDirs {
+		dir := item.Path + itemDirSuffix
+		ctx.ResourceMap[dir] = &girder.Resource{Path: dir, Type: "directory", GirderID: item.GirderID, GirderType: "item"}
+		for _, resource := range item.Contents {
+			ctx.ResourceMap[resource.Path] = resource
+		}
+	}
+}
+
+// withoutFailedItemDirs returns the local resources without the item directories of items
+// which failed to sync, or their contents, since whether they should exist isn't known.
+func withoutFailedItemDirs(ctx *girder.Context, local girder.ResourceMap) girder.ResourceMap {
+	failedDirs := make([]string, 0)
+	for p, resource := range ctx.ResourceMap {
+		if resource.SkipSync && resource.Type == "file" && resource.GirderType == "item" {
+			failedDirs = append(failedDirs, p+itemDirSuffix)
+		}
+	}
+	return withoutPaths(local, failedDirs)
+}
+
+// withItemAliases returns the local resources with each item directory also added under
+// the name of its item, so the item isn't considered missing locally.
+func withItemAliases(m girder.ResourceMap) girder.ResourceMap {
+	aliased := make(girder.ResourceMap, len(m))
+	for p, resource := range m {
+		aliased[p] = resource
+		if resource.Type == "item" {
+			alias := strings.TrimSuffix(p, itemDirSuffix)
+			aliased[alias] = &girder.Resource{Path: alias, Type: "file"}
+		}
+	}
+	return aliased
+}
+
+// extraneousItemFiles returns the files of remote items which are synced with an item
+// directory that no longer exist in it. Item directories whose item's files can't be
+// listed are marked as failed.
+func extraneousItemFiles(ctx *girder.Context, remote girder.ResourceMap) []*girder.Resource {
+	extraneous := make([]*girder.Resource, 0)
+	for p, resource := range ctx.ResourceMap {
+		if resource.Type != "item" {
+			continue
+		}
+		item, ok := remote[strings.TrimSuffix(p, itemDirSuffix)]
+		if !ok || item.GirderType != "item" {
+			continue
+		}
+		files, err := girder.ItemFiles(ctx, item.GirderID)
+		if err != nil {
+			ctx.Logger.Errorf("failed to list the files of %s, err: %s", p, err)
+			resource.SkipSync, resource.SkipReason = true, fmt.Sprintf("failed to list the files of the item, err: %s", err)
+			continue
+		}
+		for _, file := range files {
+			filePath := path.Join(p, file.Name)
+			if _, ok := ctx.ResourceMap[filePath]; !ok && !ctx.Filter.Excluded(filePath, false) {
+				extraneous = append(extraneous, &girder.Resource{Path: filePath, Type: "file", GirderID: file.ID, GirderType: "file"})
+			}
+		}
+	}
+	return extraneous
+}
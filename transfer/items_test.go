@@ -0,0 +1,91 @@
+package transfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_itemDirDeletions(t *testing.T) {
+	local := girder.ResourceMap{
+		"d":              {Path: "d", Type: "directory"},
+		"d/multi.item":   {Path: "d/multi.item", Type: "item"},
+		"d/multi.item/a": {Path: "d/multi.item/a", Type: "file"},
+	}
+	remote := girder.ResourceMap{
+		"d":       {Path: "d", Type: "directory"},
+		"d/multi": {Path: "d/multi", Type: "file"},
+		"d/gone":  {Path: "d/gone", Type: "file"},
+	}
+
+	got, numDeletions := extraneousResources(withItemAliases(local), remote)
+	if numDeletions != 1 || len(got) != 1 || got[0].Path != "d/gone" {
+		t.Errorf("extraneousResources() = %v, %d, want only d/gone", got, numDeletions)
+	}
+}
+
+func Test_isItemDir(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"d/multi.item", true},
+		{"multi.item", true},
+		{".item", false},
+		{"d/.item", false},
+		{"d/item", false},
+		{"d/multi.items", false},
+	}
+	for _, tt := range tests {
+		if got := isItemDir(tt.path); got != tt.want {
+			t.Errorf("isItemDir(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func Test_itemDirListingFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"message": "something went wrong"}`)
+	}))
+	defer server.Close()
+	p := &girder.PathAndResource{Path: filepath.Join(dir, "multi")}
+	p.Resource = &girder.Resource{Path: p.Path, Type: "file", GirderID: "item", GirderType: "item"}
+	ctx := &girder.Context{
+		URL:         server.URL,
+		Logger:      logrus.New(),
+		ItemLayout:  ItemLayoutDirectory,
+		ResourceMap: girder.ResourceMap{p.Path: p.Resource},
+	}
+	ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+
+	maybeDownloadItem(ctx, nil, p)
+	if !p.Resource.SkipSync {
+		t.Errorf("item whose files couldn't be listed wasn't marked as failed")
+	}
+	if _, err := os.Stat(p.Path + itemDirSuffix); !os.IsNotExist(err) {
+		t.Errorf("item directory was created for an item whose files couldn't be listed")
+	}
+
+	// an item directory from a previous sync is kept, since it may still be right
+	os.MkdirAll(p.Path+itemDirSuffix, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(p.Path+itemDirSuffix, "a"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "gone"), []byte("gone"), 0644)
+	deleted, _ := deleteLocalResources(ctx, dir)
+	if len(deleted) != 1 || deleted[0] != filepath.Join(dir, "gone") {
+		t.Errorf("deleteLocalResources() = %v, want only gone", deleted)
+	}
+}
@@ -0,0 +1,249 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+const (
+	MetadataNone    = "none"
+	MetadataSidecar = "sidecar"
+)
+
+// sidecarSuffix is appended to the name of a file or directory to get the name of the
+// file storing the metadata of its girder item or folder.
+const sidecarSuffix = ".girder.json"
+
+func sidecarPath(p string) string {
+	return p + sidecarSuffix
+}
+
+func isSidecar(p string) bool {
+	return strings.HasSuffix(p, sidecarSuffix)
+}
+
+// userMeta returns meta without the keys rivet manages itself, which are never written
+// to or removed by sidecars.
+func userMeta(meta map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		if k != symlinkMetaKey {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// metadataChanges returns the metadata which needs to be set on girder to turn remote
+// into local, keys which should be removed having nil values.
+func metadataChanges(local map[string]interface{}, remote map[string]interface{}) map[string]interface{} {
+	local, remote = userMeta(local), userMeta(remote)
+	changes := make(map[string]interface{})
+	for k, v := range local {
+		if remoteValue, ok := remote[k]; !ok || !reflect.DeepEqual(v, remoteValue) {
+			changes[k] = v
+		}
+	}
+	for k := range remote {
+		if _, ok := local[k]; !ok {
+			changes[k] = nil
+		}
+	}
+	return changes
+}
+
+func readSidecar(p string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]interface{})
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s, err: %s", p, err)
+	}
+	return meta, nil
+}
+
+func writeSidecar(p string, meta map[string]interface{}) error {
+	contents, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := partialPath(p)
+	if err := ioutil.WriteFile(tmpFile, append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p)
+}
+
+// downloadSidecar writes the metadata of the girder folder or item synced to the local
+// path p to its sidecar, removing the sidecar if there is no longer any metadata.
+func downloadSidecar(ctx *girder.Context, p string, girderType string, id girder.GirderID, meta map[string]interface{}) {
+	if ctx.Metadata != MetadataSidecar {
+		return
+	}
+	sp := sidecarPath(p)
+	resource := &girder.Resource{Path: sp, Type: "file", GirderID: id, GirderType: girderType}
+	meta = userMeta(meta)
+
+	existing, err := readSidecar(sp)
+	if err != nil && !os.IsNotExist(err) {
+		ctx.Logger.Warnf("replacing %s, err: %s", sp, err)
+	}
+	if len(meta) == 0 {
+		if existing == nil {
+			return
+		}
+		ctx.ResourceMap[sp] = resource
+		resource.Action = "remove metadata"
+		if !ctx.DryRun {
+			if err := os.Remove(sp); err != nil {
+				resource.SkipSync, resource.SkipReason = true, err.Error()
+				ctx.Logger.Errorf("failed to remove %s, err: %s", sp, err)
+			}
+		}
+		return
+	}
+
+	ctx.ResourceMap[sp] = resource
+	if existing != nil && reflect.DeepEqual(existing, meta) {
+		resource.Action, resource.ActionReason = "skip", "metadata unchanged"
+		return
+	}
+	resource.Action = "write metadata"
+	if ctx.DryRun {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(sp), os.ModePerm)
+	if err == nil {
+		err = writeSidecar(sp, meta)
+	}
+	if err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		ctx.Logger.Errorf("failed to write %s, err: %s", sp, err)
+	}
+}
+
+// uploadSidecar sets the metadata of the girder folder or item described by resource to
+// the contents of the sidecar sp, unless it hasn't changed since it was last uploaded.
+func uploadSidecar(ctx *girder.Context, cache *syncCache, sp string, resource *girder.Resource) {
+	st, err := os.Stat(sp)
+	if err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		return
+	}
+	if synced, ok := cache.unchangedFile(sp, st.Size(), st.ModTime()); ok && synced.ItemID == resource.GirderID {
+		resource.Action, resource.ActionReason = "skip", "unchanged since last sync"
+		cache.recordFile(sp, synced)
+		return
+	}
+
+	local, err := readSidecar(sp)
+	if err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		ctx.Logger.Error(err)
+		return
+	}
+
+	// the folder or item would have been created, so it has no metadata yet
+	var remote *girder.GirderObject
+	if resource.GirderID == "" {
+		remote = new(girder.GirderObject)
+	} else if resource.GirderType == "folder" {
+		remote, err = girder.GetFolder(ctx, resource.GirderID)
+	} else {
+		remote, err = girder.GetItem(ctx, resource.GirderID)
+	}
+	if err != nil {
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		ctx.Logger.Errorf("failed to retrieve metadata for %s, err: %s", sp, err)
+		return
+	}
+
+	changes := metadataChanges(local, remote.Meta)
+	if len(changes) == 0 {
+		resource.Action, resource.ActionReason = "skip", "metadata unchanged"
+	} else {
+		keys := make([]string, 0, len(changes))
+		for k := range changes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		resource.Action, resource.ActionReason = "update metadata", strings.Join(keys, ", ")
+		if ctx.DryRun {
+			return
+		}
+		ctx.Logger.Infof("updating metadata: %s\n", sp)
+		if err := girder.SetMetadata(ctx, resource.GirderType, resource.GirderID, changes); err != nil {
+			resource.SkipSync, resource.SkipReason = true, err.Error()
+			ctx.Logger.Errorf("failed to update metadata from %s, err: %s", sp, err)
+			return
+		}
+	}
+	cache.recordFile(sp, &syncedFile{Size: st.Size(), ModTime: st.ModTime(), ItemID: resource.GirderID})
+}
+
+// uploadSidecars updates the metadata of every synced folder and item which has a
+// sidecar, adding the sidecars to the resource map.
+func uploadSidecars(ctx *girder.Context, cache *syncCache) {
+	if ctx.Metadata != MetadataSidecar {
+		return
+	}
+
+	sidecars := make(map[string]*girder.Resource)
+	for p, resource := range ctx.ResourceMap {
+		if resource.SkipSync || (resource.Type != "file" && resource.Type != "directory" && resource.Type != "item") {
+			continue
+		} else if resource.GirderID == "" && !ctx.DryRun {
+			continue
+		} else if inItemDir(ctx, resource) {
+			// these are files of an item, which have no metadata of their own
+			continue
+		}
+		sp := sidecarPath(p)
+		if resource.Type == "item" {
+			// named after the item rather than its directory, as when downloading
+			sp = sidecarPath(strings.TrimSuffix(p, itemDirSuffix))
+		}
+		if _, err := os.Stat(sp); err != nil {
+			if !os.IsNotExist(err) {
+				ctx.Logger.Warnf("failed to access %s, err: %s", sp, err)
+			}
+			continue
+		}
+		girderType := "item"
+		if resource.Type == "directory" {
+			girderType = "folder"
+		}
+		sidecars[sp] = &girder.Resource{Path: sp, Type: "file", GirderID: resource.GirderID, GirderType: girderType}
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 1; w <= numWorkers(ctx.Workers, DefaultWorkers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sp := range jobs {
+				if !skipIfInterrupted(ctx, sidecars[sp]) {
+					uploadSidecar(ctx, cache, sp, sidecars[sp])
+				}
+			}
+		}()
+	}
+	for sp, resource := range sidecars {
+		ctx.ResourceMap[sp] = resource
+		jobs <- sp
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,47 @@
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_metadataChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  map[string]interface{}
+		remote map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name:   "unchanged",
+			local:  map[string]interface{}{"a": "1", "b": map[string]interface{}{"c": 2.0}},
+			remote: map[string]interface{}{"a": "1", "b": map[string]interface{}{"c": 2.0}},
+			want:   map[string]interface{}{},
+		},
+		{
+			name:   "added and changed",
+			local:  map[string]interface{}{"a": "1", "b": 3.0},
+			remote: map[string]interface{}{"b": 2.0},
+			want:   map[string]interface{}{"a": "1", "b": 3.0},
+		},
+		{
+			name:   "removed",
+			local:  map[string]interface{}{},
+			remote: map[string]interface{}{"a": "1"},
+			want:   map[string]interface{}{"a": nil},
+		},
+		{
+			name:   "symlink target is left alone",
+			local:  map[string]interface{}{},
+			remote: map[string]interface{}{symlinkMetaKey: "target"},
+			want:   map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metadataChanges(tt.local, tt.remote); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadataChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// PlanFolders records that the girder folders at paths, which are missing from the end of
+// the destination of a dry run, would be created. They're keyed by their girder:// URL so
+// they can't be mistaken for local paths.
+func PlanFolders(ctx *girder.Context, paths []string) {
+	for _, p := range paths {
+		key := "girder://" + p
+		ctx.ResourceMap[key] = &girder.Resource{Path: key, Type: "folder", GirderType: "folder", Action: "create folder"}
+	}
+}
+
+// printPlan prints what a dry run determined sync would do with each resource,
+// along with anything that would be deleted. The plan is printed to stderr when stdout
+// is reserved for events.
+func printPlan(ctx *girder.Context, deleted []string) {
+	out := os.Stdout
+	if ctx.Events != nil {
+		out = os.Stderr
+	}
+
+	paths := make([]string, 0, len(ctx.ResourceMap))
+	for p := range ctx.ResourceMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	counts := make(map[string]int)
+	fmt.Fprintln(out, "plan:")
+	for _, p := range paths {
+		resource := ctx.ResourceMap[p]
+		action, reason := resource.Action, resource.ActionReason
+		if resource.SkipSync {
+			action, reason = "fail", resource.SkipReason
+		} else if action == "" {
+			continue
+		}
+		counts[action]++
+
+		if reason != "" {
+			fmt.Fprintf(out, "%-16s %s (%s)\n", action, p, reason)
+		} else {
+			fmt.Fprintf(out, "%-16s %s\n", action, p)
+		}
+	}
+	for _, p := range deleted {
+		fmt.Fprintf(out, "%-16s %s\n", "delete", p)
+	}
+	if len(deleted) > 0 {
+		counts["delete"] = len(deleted)
+	}
+
+	actions := make([]string, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "dry run, no changes were made:")
+	for _, action := range actions {
+		fmt.Fprintf(out, "%-16s %d\n", action, counts[action])
+	}
+	if ctx.NumExcluded > 0 {
+		fmt.Fprintf(out, "%-16s %d\n", "exclude", ctx.NumExcluded)
+	}
+}
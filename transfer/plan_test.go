@@ -0,0 +1,57 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPlanFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "src", "d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "src", "a"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", "d", "b"), []byte("b"), 0644)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+
+	// nothing within a destination which would be created needs to be looked up
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	ctx := &girder.Context{URL: server.URL, Logger: logrus.New(), DryRun: true, ResourceMap: make(girder.ResourceMap)}
+	PlanFolders(ctx, []string{"collection/c/new", "collection/c/new/newer"})
+
+	Upload(ctx, filepath.Join(dir, "src"), "")
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("Upload() made %d requests, want a plan without any", n)
+	}
+	want := map[string]string{
+		"girder://collection/c/new":       "create folder",
+		"girder://collection/c/new/newer": "create folder",
+		"d":                               "create folder",
+		"a":                               "upload",
+		"d/b":                             "upload",
+	}
+	for p, action := range want {
+		if resource, ok := ctx.ResourceMap[p]; !ok || resource.Action != action {
+			t.Errorf("planned %s = %+v, want %s", p, resource, action)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/danlamanna/rivet/util"
+)
+
+// progressInterval is how often the progress display is redrawn, and rateWindow how far
+// back the transfer rate is averaged over.
+const (
+	progressInterval = 500 * time.Millisecond
+	rateWindow       = 5 * time.Second
+)
+
+// progress tracks how much of a sync has been transferred, drawing it below the log
+// output of the sync. Files are planned once they're known to need syncing, and finished
+// once they've been transferred or turned out not to need it.
+type progress struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	logOut io.Writer
+	verb   string
+
+	totalFiles, doneFiles   int
+	totalBytes, transferred int64
+
+	// active are the files being transferred by the workers, by path
+	active  map[string]*activeFile
+	samples []progressSample
+
+	// lines is how many lines of the display are currently drawn
+	lines int
+
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+type activeFile struct {
+	size, done int64
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// startProgress begins displaying the progress of the sync, if ctx wants it displayed.
+// verb describes the direction of the sync, e.g. uploading.
+func startProgress(ctx *girder.Context, verb string) {
+	if ctx.Progress == nil || ctx.DryRun {
+		return
+	}
+	p := &progress{
+		out:     ctx.Progress,
+		logOut:  ctx.Logger.Out,
+		verb:    verb,
+		active:  make(map[string]*activeFile),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// logs are written above the display rather than through it
+	ctx.Logger.SetOutput(p)
+	ctx.Tracker = p
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mutex.Lock()
+				p.sample(time.Now())
+				p.clear()
+				p.draw()
+				p.mutex.Unlock()
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// stopProgress removes the progress display, leaving only the overall totals.
+func stopProgress(ctx *girder.Context) {
+	p, ok := ctx.Tracker.(*progress)
+	if !ok || p == nil {
+		return
+	}
+	close(p.stopped)
+	<-p.done
+
+	p.mutex.Lock()
+	p.clear()
+	p.active = make(map[string]*activeFile)
+	p.draw()
+	p.lines = 0
+	p.mutex.Unlock()
+
+	ctx.Logger.SetOutput(p.logOut)
+	ctx.Tracker = nil
+}
+
+// tracker is what follows the progress of the sync, which does nothing if it isn't being
+// displayed.
+func tracker(ctx *girder.Context) girder.ProgressTracker {
+	if ctx.Tracker == nil {
+		return (*progress)(nil)
+	}
+	return ctx.Tracker
+}
+
+// Plan adds a file of size bytes to what's expected to be synced.
+func (p *progress) Plan(size int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.totalFiles++
+	p.totalBytes += size
+}
+
+// Start marks the file at path as being transferred from offset, which was transferred
+// by a previous sync.
+func (p *progress) Start(path string, size int64, offset int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.totalBytes -= offset
+	p.active[path] = &activeFile{size: size, done: offset}
+}
+
+// Add records that n more bytes of the file at path were transferred.
+func (p *progress) Add(path string, n int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.transferred += n
+	if f, ok := p.active[path]; ok {
+		f.done += n
+	}
+}
+
+// End marks the file at path as no longer being transferred.
+func (p *progress) End(path string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.active, path)
+}
+
+// Finish records that a planned resource is done with, no longer expecting its bytes
+// unless it was transferred.
+func (p *progress) Finish(resource *girder.Resource) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.doneFiles++
+	if resource.SkipSync || resource.Action == "skip" || resource.Action == "" || resource.LinkTarget != "" {
+		p.totalBytes -= resource.Size
+	}
+}
+
+// Write writes log output above the progress display.
+func (p *progress) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	n, err := p.logOut.Write(b)
+	p.draw()
+	return n, err
+}
+
+func (p *progress) sample(now time.Time) {
+	p.samples = append(p.samples, progressSample{at: now, bytes: p.transferred})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].at) > rateWindow {
+		p.samples = p.samples[1:]
+	}
+}
+
+// rate is the bytes per second transferred recently.
+func (p *progress) rate() float64 {
+	if len(p.samples) < 2 {
+		return 0
+	}
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// clear erases the display so something else can be written in its place.
+func (p *progress) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+func (p *progress) draw() {
+	lines := p.render(terminalWidth(p.out))
+	for _, line := range lines {
+		fmt.Fprintln(p.out, line)
+	}
+	p.lines = len(lines)
+}
+
+// render returns the lines of the display, none of which are wider than width.
+func (p *progress) render(width int) []string {
+	total := p.totalBytes
+	if total < p.transferred {
+		total = p.transferred
+	}
+	header := fmt.Sprintf("%s %s / %s", p.verb, formatBytes(p.transferred), formatBytes(total))
+	if total > 0 {
+		header += fmt.Sprintf(" (%d%%)", p.transferred*100/total)
+	}
+	header += fmt.Sprintf("  %d/%d files", p.doneFiles, p.totalFiles)
+	if rate := p.rate(); rate > 0 {
+		header += fmt.Sprintf("  %s/s", formatBytes(int64(rate)))
+		eta := time.Duration(float64(total-p.transferred) / rate * float64(time.Second))
+		header += fmt.Sprintf("  ETA %s", eta.Round(time.Second))
+	}
+	lines := []string{truncateLeft(header, width)}
+
+	paths := make([]string, 0, len(p.active))
+	for path := range p.active {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		f := p.active[path]
+		status := fmt.Sprintf("  %s / %s", formatBytes(f.done), formatBytes(f.size))
+		lines = append(lines, "  "+truncateLeft(path, width-len(status)-2)+status)
+	}
+	return lines
+}
+
+// formatBytes formats n bytes in the largest binary unit it has at least one of.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// truncateLeft shortens s to width by removing the start of it, which for paths is
+// usually the least interesting part.
+func truncateLeft(s string, width int) string {
+	if width < 4 || len(s) <= width {
+		return s
+	}
+	return "..." + s[len(s)-width+3:]
+}
+
+// terminalWidth is the width of the terminal out is written to, which is looked up each
+// time so resizing the terminal is followed, falling back to $COLUMNS, which shells set,
+// or 80.
+func terminalWidth(out io.Writer) int {
+	if f, ok := out.(*os.File); ok {
+		if width := util.TerminalWidth(f); width > 0 {
+			return width
+		}
+	}
+	if columns, err := strconv.Atoi(strings.TrimSpace(os.Getenv("COLUMNS"))); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// progressWriter counts the bytes written through it towards the progress of path.
+type progressWriter struct {
+	w       io.Writer
+	path    string
+	tracker girder.ProgressTracker
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.tracker.Add(w.path, int64(n))
+	return n, err
+}
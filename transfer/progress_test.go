@@ -0,0 +1,76 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+func Test_formatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{16 * 1024 * 1024, "16.0 MiB"},
+		{3 * 1024 * 1024 * 1024 * 1024, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func Test_progressRender(t *testing.T) {
+	p := &progress{verb: "uploading", active: make(map[string]*activeFile)}
+	p.Plan(1024)
+	p.Plan(3072)
+	p.Plan(4096)
+
+	// skipped files are no longer expected, resumed files only count what's left
+	p.Finish(&girder.Resource{Size: 4096, Action: "skip"})
+	p.Start("a/resumed", 3072, 1024)
+	p.Add("a/resumed", 1024)
+
+	lines := p.render(80)
+	if len(lines) != 2 {
+		t.Fatalf("render() = %q, want a header and one active file", lines)
+	}
+	if want := "uploading 1.0 KiB / 3.0 KiB (33%)  1/3 files"; lines[0] != want {
+		t.Errorf("header = %q, want %q", lines[0], want)
+	}
+	if !strings.HasPrefix(lines[1], "  a/resumed") || !strings.HasSuffix(lines[1], "2.0 KiB / 3.0 KiB") {
+		t.Errorf("active file = %q", lines[1])
+	}
+
+	p.End("a/resumed")
+	long := strings.Repeat("d/", 50) + "f"
+	p.Start(long, 10, 0)
+	for _, line := range p.render(40) {
+		if len(line) > 40 {
+			t.Errorf("%q is wider than 40", line)
+		}
+	}
+}
+
+func Test_terminalWidth(t *testing.T) {
+	columns := os.Getenv("COLUMNS")
+	defer os.Setenv("COLUMNS", columns)
+
+	// output which isn't a terminal falls back to what the shell reports
+	os.Setenv("COLUMNS", "100")
+	if got := terminalWidth(new(bytes.Buffer)); got != 100 {
+		t.Errorf("terminalWidth() = %d with COLUMNS=100, want 100", got)
+	}
+	os.Unsetenv("COLUMNS")
+	if got := terminalWidth(new(bytes.Buffer)); got != 80 {
+		t.Errorf("terminalWidth() = %d without COLUMNS, want 80", got)
+	}
+}
@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"sort"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+// Outcome is what happened to a single path during a sync, and why.
+type Outcome struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Result summarizes what a sync did with every path it considered.
+type Result struct {
+	// Succeeded were transferred or created, Skipped were already up to date or
+	// couldn't be represented, and Failed couldn't be synced due to an error.
+	Succeeded []Outcome `json:"succeeded"`
+	Skipped   []Outcome `json:"skipped"`
+	Failed    []Outcome `json:"failed"`
+
+	// Interrupted is how many paths weren't synced because the sync was interrupted.
+	Interrupted int `json:"interrupted"`
+
+	// Excluded is how many paths were excluded by filters.
+	Excluded int `json:"excluded"`
+
+	// Deleted were removed from the destination by --delete.
+	Deleted []string `json:"deleted"`
+
+	// Error is why the sync couldn't be started, in which case nothing was synced.
+	Error string `json:"error,omitempty"`
+}
+
+// OK reports whether everything was synced.
+func (r *Result) OK() bool {
+	return len(r.Failed) == 0 && r.Interrupted == 0 && r.Error == ""
+}
+
+// Abort ends a sync which couldn't be started because of err, emitting a summary of
+// it so the events of every sync end with one.
+func Abort(ctx *girder.Context, err error) *Result {
+	result := &Result{
+		Succeeded: []Outcome{},
+		Skipped:   []Outcome{},
+		Failed:    []Outcome{},
+		Deleted:   []string{},
+		Error:     err.Error(),
+	}
+	emitSummary(ctx, result)
+	return result
+}
+
+// newResult classifies every resource of the sync.
+func newResult(ctx *girder.Context, deleted []string) *Result {
+	result := &Result{
+		Succeeded: []Outcome{},
+		Skipped:   []Outcome{},
+		Failed:    []Outcome{},
+		Excluded:  ctx.NumExcluded,
+		Deleted:   append([]string{}, deleted...),
+	}
+
+	paths := make([]string, 0, len(ctx.ResourceMap))
+	for p := range ctx.ResourceMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		resource := ctx.ResourceMap[p]
+		if wasInterrupted(ctx, resource) {
+			result.Interrupted++
+		} else if resource.SkipSync {
+			result.Failed = append(result.Failed, Outcome{Path: p, Reason: resource.SkipReason})
+		} else if resource.Action == "skip" {
+			result.Skipped = append(result.Skipped, Outcome{Path: p, Reason: resource.ActionReason})
+		} else {
+			result.Succeeded = append(result.Succeeded, Outcome{Path: p, Reason: resource.Action})
+		}
+	}
+	return result
+}
+
+// printSummary logs the result of a sync.
+func printSummary(ctx *girder.Context, result *Result) {
+	ctx.Logger.Info("")
+	ctx.Logger.Info("summary:")
+
+	ctx.Logger.Infof("successfully synced %d files/folders", len(result.Succeeded))
+	if len(result.Skipped) > 0 {
+		ctx.Logger.Infof("skipped %d files/folders which were up to date or can't be synced", len(result.Skipped))
+		for _, skipped := range result.Skipped {
+			ctx.Logger.Debugf("%s: %s", skipped.Path, skipped.Reason)
+		}
+	}
+	if result.Excluded > 0 {
+		ctx.Logger.Infof("excluded %d files/folders", result.Excluded)
+	}
+
+	if len(result.Failed) > 0 {
+		ctx.Logger.Infof("failed to sync %d files/folders:", len(result.Failed))
+
+		for _, failure := range result.Failed {
+			ctx.Logger.Infof("%s: %s", failure.Path, failure.Reason)
+		}
+	}
+
+	if result.Interrupted > 0 {
+		ctx.Logger.Warnf("interrupted, %d files/folders were not synced", result.Interrupted)
+	}
+
+	logDeletions(ctx, result.Deleted)
+}
@@ -0,0 +1,44 @@
+package transfer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+func Test_newResult(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	ctx := &girder.Context{Ctx: c, NumExcluded: 2, ResourceMap: girder.ResourceMap{
+		"d/new":         {Path: "d/new", Action: "upload"},
+		"d/same":        {Path: "d/same", Action: "skip", ActionReason: "unchanged"},
+		"d/broken":      {Path: "d/broken", SkipSync: true, SkipReason: "permission denied"},
+		"d/interrupted": {Path: "d/interrupted", SkipSync: true, SkipReason: interruptedReason},
+	}}
+
+	result := newResult(ctx, []string{"d/gone"})
+	if len(result.Succeeded) != 1 || result.Succeeded[0].Path != "d/new" {
+		t.Errorf("Succeeded = %v, want only d/new", result.Succeeded)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Reason != "unchanged" {
+		t.Errorf("Skipped = %v, want only d/same", result.Skipped)
+	}
+	// interrupted resources are only counted as such once the sync is interrupted
+	if len(result.Failed) != 2 || result.Interrupted != 0 || result.OK() {
+		t.Errorf("Failed = %v, Interrupted = %d, want 2 failures", result.Failed, result.Interrupted)
+	}
+	if result.Excluded != 2 || len(result.Deleted) != 1 {
+		t.Errorf("Excluded = %d, Deleted = %v, want 2 and d/gone", result.Excluded, result.Deleted)
+	}
+
+	cancel()
+	result = newResult(ctx, nil)
+	if len(result.Failed) != 1 || result.Failed[0].Path != "d/broken" || result.Interrupted != 1 {
+		t.Errorf("Failed = %v, Interrupted = %d, want d/broken and 1", result.Failed, result.Interrupted)
+	}
+
+	ok := newResult(&girder.Context{ResourceMap: girder.ResourceMap{"a": {Path: "a", Action: "upload"}}}, nil)
+	if !ok.OK() {
+		t.Errorf("OK() = false for a fully synced result")
+	}
+}
@@ -0,0 +1,218 @@
+package transfer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/danlamanna/rivet/config"
+	"github.com/danlamanna/rivet/girder"
+	"github.com/danlamanna/rivet/util"
+)
+
+// pendingUpload is an upload which was started but may not have finished, so that it
+// can be continued by a later run rather than starting over.
+type pendingUpload struct {
+	URL     string    `json:"url"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+
+	// ParentID is the item a new file is being uploaded to, or the file whose
+	// contents are being replaced.
+	ParentID girder.GirderID `json:"parentId"`
+	UploadID girder.GirderID `json:"uploadId"`
+
+	// Received is how many bytes girder should have received of an upload whose chunks
+	// are sent in parallel, nil if they're sent in order. Girder only counts the bytes it
+	// receives, so the upload is only resumed if it has received exactly this many,
+	// otherwise a chunk was received after one which wasn't.
+	Received *int64 `json:"received,omitempty"`
+}
+
+// uploadState persists pending uploads to a file, it is safe for concurrent use. Other
+// runs of rivet may be uploading at the same time, so the file is locked while it's
+// changed and only the uploads this run changes are written.
+type uploadState struct {
+	sync.Mutex
+	file    string
+	uploads map[string]*pendingUpload
+}
+
+func pendingUploadKey(ctx *girder.Context, absPath string) string {
+	return ctx.URL + "|" + absPath
+}
+
+// loadUploadState reads pending uploads from the state file. If the file can't be used
+// uploads still work, they just can't be resumed.
+func loadUploadState(ctx *girder.Context) *uploadState {
+	state := &uploadState{uploads: make(map[string]*pendingUpload)}
+
+	configDir, err := config.Dir()
+	if err != nil {
+		ctx.Logger.Warnf("unable to determine state directory, uploads won't be resumable. err: %s", err)
+		return state
+	}
+	state.file = path.Join(configDir, "uploads.json")
+
+	uploads, err := readPendingUploads(state.file)
+	if err != nil {
+		ctx.Logger.Warnf("failed to read %s, err: %s", state.file, err)
+		return state
+	}
+	state.uploads = uploads
+	return state
+}
+
+func readPendingUploads(file string) (map[string]*pendingUpload, error) {
+	pending := make(map[string]*pendingUpload)
+	contents, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	uploads := make([]*pendingUpload, 0)
+	if err := json.Unmarshal(contents, &uploads); err != nil {
+		return nil, err
+	}
+	for _, upload := range uploads {
+		pending[upload.URL+"|"+upload.Path] = upload
+	}
+	return pending, nil
+}
+
+// save records upload as the pending upload of key in the state file, or removes it if
+// upload is nil, keeping the pending uploads of other runs. The caller must hold the
+// lock of s.
+func (s *uploadState) save(key string, upload *pendingUpload) error {
+	if s.file == "" {
+		return nil
+	}
+	unlock, err := config.Lock(s.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := readPendingUploads(s.file)
+	if err != nil {
+		// the file is only a record of what can be resumed, so it's replaced
+		pending = make(map[string]*pendingUpload)
+	}
+	if upload != nil {
+		pending[key] = upload
+	} else {
+		delete(pending, key)
+	}
+
+	uploads := make([]*pendingUpload, 0, len(pending))
+	for _, upload := range pending {
+		uploads = append(uploads, upload)
+	}
+	contents, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.file, contents, 0600)
+}
+
+// resume returns the ID of a previously started upload of fullPath, along with the
+// offset girder has confirmed receiving. An empty ID means the upload must start over,
+// either because there was none or the local file has changed since.
+func (s *uploadState) resume(ctx *girder.Context, fullPath string, fi os.FileInfo, parentID girder.GirderID) (girder.GirderID, int64) {
+	absPath, _ := filepath.Abs(fullPath)
+	key := pendingUploadKey(ctx, absPath)
+
+	s.Lock()
+	upload, ok := s.uploads[key]
+	s.Unlock()
+	if !ok {
+		return "", 0
+	}
+
+	if upload.Size != fi.Size() || !upload.ModTime.Equal(fi.ModTime()) || upload.ParentID != parentID {
+		ctx.Logger.Debugf("%s changed since its upload was started, starting over", fullPath)
+		s.finish(ctx, fullPath)
+		return "", 0
+	}
+
+	offset, err := girder.UploadOffset(ctx, upload.UploadID)
+	if err != nil {
+		ctx.Logger.Debugf("unable to resume upload of %s, starting over. err: %s", fullPath, err)
+		s.finish(ctx, fullPath)
+		return "", 0
+	} else if upload.Received != nil && offset != *upload.Received {
+		ctx.Logger.Debugf("unable to resume upload of %s, girder received %d bytes rather than %d, starting over", fullPath, offset, *upload.Received)
+		s.finish(ctx, fullPath)
+		return "", 0
+	}
+	ctx.Logger.Infof("resuming upload of %s at %d/%d bytes\n", fullPath, offset, fi.Size())
+	return upload.UploadID, offset
+}
+
+// start records that an upload of fullPath has begun, whose chunks are sent in parallel
+// if parallel is set.
+func (s *uploadState) start(ctx *girder.Context, fullPath string, fi os.FileInfo, parentID girder.GirderID, uploadID girder.GirderID, parallel bool) {
+	absPath, _ := filepath.Abs(fullPath)
+
+	s.Lock()
+	defer s.Unlock()
+	upload := &pendingUpload{
+		URL:      ctx.URL,
+		Path:     absPath,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		ParentID: parentID,
+		UploadID: uploadID,
+	}
+	if parallel {
+		// if rivet exits without recording what was received, only an upload girder
+		// hasn't received anything of can be resumed
+		upload.Received = new(int64)
+	}
+	key := pendingUploadKey(ctx, absPath)
+	s.uploads[key] = upload
+	if err := s.save(key, upload); err != nil {
+		ctx.Logger.Warnf("failed to save upload state, err: %s", err)
+	}
+}
+
+// stopped records that the upload of fullPath, whose chunks were sent in parallel,
+// stopped once girder should have received the first received bytes of it.
+func (s *uploadState) stopped(ctx *girder.Context, fullPath string, received int64) {
+	absPath, _ := filepath.Abs(fullPath)
+
+	s.Lock()
+	defer s.Unlock()
+	key := pendingUploadKey(ctx, absPath)
+	upload, ok := s.uploads[key]
+	if !ok {
+		return
+	}
+	upload.Received = &received
+	if err := s.save(key, upload); err != nil {
+		ctx.Logger.Warnf("failed to save upload state, err: %s", err)
+	}
+}
+
+// finish forgets about the upload of fullPath.
+func (s *uploadState) finish(ctx *girder.Context, fullPath string) {
+	absPath, _ := filepath.Abs(fullPath)
+
+	s.Lock()
+	defer s.Unlock()
+	key := pendingUploadKey(ctx, absPath)
+	if _, ok := s.uploads[key]; !ok {
+		return
+	}
+	delete(s.uploads, key)
+	if err := s.save(key, nil); err != nil {
+		ctx.Logger.Warnf("failed to save upload state, err: %s", err)
+	}
+}
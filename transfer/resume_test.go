@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_transferContentsResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := bytes.Repeat([]byte("0123456789"), 150)
+	fullPath := filepath.Join(dir, "f")
+	ioutil.WriteFile(fullPath, contents, 0644)
+	fi, _ := os.Stat(fullPath)
+	stateFile := filepath.Join(dir, "uploads.json")
+
+	server, received, _ := chunkServer(t, fi.Size(), true)
+	defer server.Close()
+	c, cancel := context.WithCancel(context.Background())
+	ctx := &girder.Context{URL: server.URL, Logger: logrus.New(), Ctx: c, ChunkSize: 512}
+	ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+	ctx.Events = girder.NewEventStream(&cancelAfterChunks{chunks: 1, cancel: cancel})
+
+	state := &uploadState{file: stateFile, uploads: make(map[string]*pendingUpload)}
+	if _, err := transferContents(ctx, state, fullPath, fi, "item", func() (girder.GirderID, error) {
+		return "upload", nil
+	}); err == nil {
+		t.Fatal("transferContents() succeeded after being interrupted")
+	}
+
+	// a later run continues the upload girder has the first chunk of
+	ctx.Ctx, ctx.Events = context.Background(), nil
+	uploads, err := readPendingUploads(stateFile)
+	if err != nil || len(uploads) != 1 {
+		t.Fatalf("%d uploads are pending, want the interrupted upload. err: %v", len(uploads), err)
+	}
+	state = &uploadState{file: stateFile, uploads: uploads}
+	remote, err := transferContents(ctx, state, fullPath, fi, "item", func() (girder.GirderID, error) {
+		t.Error("a new upload was started rather than resuming the interrupted upload")
+		return "", nil
+	})
+	if err != nil || remote == nil || remote.ID != "file" {
+		t.Fatalf("resumed transferContents() = %v, %v, want the file", remote, err)
+	}
+	if !bytes.Equal(received(), contents) {
+		t.Errorf("girder received different contents after resuming")
+	}
+	if uploads, _ := readPendingUploads(stateFile); len(uploads) != 0 {
+		t.Errorf("%d uploads are pending after finishing, want none", len(uploads))
+	}
+
+	// the contents of the file changing means starting over
+	state.start(ctx, fullPath, fi, "item", "upload", false)
+	ioutil.WriteFile(fullPath, append(contents, '!'), 0644)
+	changed, _ := os.Stat(fullPath)
+	if uploadID, _ := state.resume(ctx, fullPath, changed, "item"); uploadID != "" {
+		t.Errorf("resume() of a changed file = %s, want to start over", uploadID)
+	}
+}
+
+func Test_uploadStateConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "uploads.json")
+	fullPath := filepath.Join(dir, "f")
+	ioutil.WriteFile(fullPath, []byte("contents"), 0644)
+	fi, _ := os.Stat(fullPath)
+
+	// separate states, like separate runs of rivet, don't lose each other's uploads
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := &girder.Context{URL: string(rune('a' + i)), Logger: logrus.New()}
+			state := &uploadState{file: stateFile, uploads: make(map[string]*pendingUpload)}
+			state.start(ctx, fullPath, fi, "item", "upload", false)
+		}(i)
+	}
+	wg.Wait()
+	if uploads, err := readPendingUploads(stateFile); err != nil || len(uploads) != 10 {
+		t.Errorf("%d uploads are pending, want 10. err: %v", len(uploads), err)
+	}
+
+	// failed uploads of a single chunk aren't recorded, since they'd be sent again anyway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"message": "something went wrong"}`)
+	}))
+	defer server.Close()
+	ctx := &girder.Context{URL: server.URL, Logger: logrus.New(), ChunkSize: 512}
+	ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+	state := &uploadState{file: stateFile, uploads: make(map[string]*pendingUpload)}
+	if _, err := transferContents(ctx, state, fullPath, fi, "item", func() (girder.GirderID, error) {
+		return "upload", nil
+	}); err == nil {
+		t.Fatal("transferContents() succeeded when girder failed")
+	}
+	if uploads, _ := readPendingUploads(stateFile); len(uploads) != 10 {
+		t.Errorf("%d uploads are pending after a single chunk upload failed, want 10", len(uploads))
+	}
+}
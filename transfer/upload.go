@@ -1,9 +1,8 @@
 package transfer
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"net/url"
 	"os"
 	"path"
@@ -11,121 +10,502 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/danlamanna/rivet/filter"
 	"github.com/danlamanna/rivet/girder"
 	"github.com/danlamanna/rivet/util"
 )
 
-const maxChunkSize = 1024 * 1024 * 16
-
-// build these synchronously or use a better data structure for determining when parents are created
-func buildGirderDirs(ctx *girder.Context, baseDir string) {
-
-	// get directories to build in sorted order (to avoid extraneous girder POST requests)
-	dirsToBuild := make([]string, 0)
+// buildGirderDirs creates the girder folder of each local directory. Directories at the
+// same depth are created concurrently, once all of the directories above them have been.
+func buildGirderDirs(ctx *girder.Context, cache *syncCache) {
+	levels := make([][]string, 0)
 	for k, v := range ctx.ResourceMap {
-		if v.Type == "directory" {
-			dirsToBuild = append(dirsToBuild, k)
+		if v.Type != "directory" {
+			continue
+		}
+		depth := strings.Count(k, "/")
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], k)
+	}
+
+	for _, dirsToBuild := range levels {
+		// sorted so progress through each level is predictable
+		sort.Strings(dirsToBuild)
+
+		dirs := make(chan string)
+		var wg sync.WaitGroup
+		for w := 1; w <= numWorkers(ctx.FolderWorkers, DefaultFolderWorkers); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for v := range dirs {
+					buildGirderDir(ctx, cache, v)
+				}
+			}()
+		}
+		for _, v := range dirsToBuild {
+			dirs <- v
 		}
+		close(dirs)
+		wg.Wait()
+	}
+}
 
+// buildGirderDir creates the girder folder of the local directory v, whose parent folders
+// must already exist.
+func buildGirderDir(ctx *girder.Context, cache *syncCache, v string) {
+	if skipIfInterrupted(ctx, ctx.ResourceMap[v]) {
+		return
+	}
+	if id, ok := cache.folder(v); ok {
+		ctx.ResourceMap[v].GirderType = "folder"
+		ctx.ResourceMap[v].GirderID = id
+		ctx.ResourceMap[v].Action, ctx.ResourceMap[v].ActionReason = "skip", "unchanged since last sync"
+		cache.recordFolder(v, id)
+		return
+	}
+	if id, created, err := girder.GetOrCreateFolderRecursive(ctx, v); err == nil && id != "" {
+		cache.recordFolder(v, id)
+		if created {
+			emit(ctx, Event{Event: "folder_created", Path: v, GirderID: id})
+		}
 	}
-	sort.Slice(dirsToBuild, func(i, j int) bool { return dirsToBuild[i] < dirsToBuild[j] })
+}
+
+// The values of the ChunkOrder of a context. Assetstores which write files sequentially,
+// such as the filesystem assetstore, refuse a chunk sent ahead of those before it, after
+// which chunks are only sent in order.
+const (
+	chunkOrderUnknown int32 = iota
+	chunkOrderAny
+	chunkOrderRequired
+)
 
-	for _, v := range dirsToBuild {
-		girder.GetOrCreateFolderRecursive(ctx, v)
+// unresumableError is an upload failure which left gaps in what girder received, so the
+// upload can't be continued from the offset girder reports.
+type unresumableError struct {
+	error
+}
+
+// partialUploadError is an upload which stopped after chunks were sent in parallel, which
+// can only be continued if girder has received exactly the first received bytes.
+type partialUploadError struct {
+	error
+	received int64
+}
+
+func uploadChunkSize(ctx *girder.Context) int64 {
+	if ctx.ChunkSize < 1 {
+		return DefaultChunkSize
 	}
+	return ctx.ChunkSize
+}
+
+// sendsInParallel reports whether the chunks of a file of size bytes are sent in
+// parallel from offset onward.
+func sendsInParallel(ctx *girder.Context, size int64, offset int64) bool {
+	return numWorkers(ctx.ChunkParallelism, DefaultChunkParallelism) > 1 && size-offset > uploadChunkSize(ctx) &&
+		atomic.LoadInt32(&ctx.ChunkOrder) != chunkOrderRequired
 }
 
-func _uploadBytes(ctx *girder.Context, upload girder.GirderID, fullPath string, fi os.FileInfo) {
+// _uploadBytes sends the contents of fullPath from offset onward, returning the girder
+// file once the final chunk has been received. Chunks are sent in parallel if configured
+// and girder accepts them, otherwise in order.
+func _uploadBytes(ctx *girder.Context, upload girder.GirderID, fullPath string, fi os.FileInfo, offset int64) (*girder.GirderFile, error) {
 
 	file, err := os.Open(fullPath)
 	if err != nil {
-		ctx.Logger.Warnf("failed to access %s, skipping. err: %s", fullPath, err)
-		return
+		return nil, fmt.Errorf("failed to access %s, err: %s", fullPath, err)
 	}
 	defer file.Close()
 
-	totalChunks := util.Max(0, fi.Size()/maxChunkSize) + 1
-	var offset int64
-	i := 1
-	for {
-		bufSize := util.Min(maxChunkSize, fi.Size()-offset)
-		buffer := make([]byte, bufSize)
-		_, err := file.Read(buffer)
+	chunkSize := uploadChunkSize(ctx)
+	parallel := sendsInParallel(ctx, fi.Size(), offset)
+	sent := make(map[int64]bool)
+	if parallel && atomic.LoadInt32(&ctx.ChunkOrder) == chunkOrderUnknown {
+		// find out whether girder accepts chunks out of order by sending only the second
+		// chunk, rather than sending many which would all be refused
+		buffer := make([]byte, chunkSize)
+		_, err := uploadChunk(ctx, upload, file, fullPath, fi, buffer, offset+chunkSize, chunkSize)
+		if err == errChunkOutOfOrder {
+			atomic.StoreInt32(&ctx.ChunkOrder, chunkOrderRequired)
+		} else if err != nil {
+			return nil, unresumableError{err}
+		} else {
+			atomic.StoreInt32(&ctx.ChunkOrder, chunkOrderAny)
+			sent[offset+chunkSize] = true
+		}
+	}
+	if parallel && atomic.LoadInt32(&ctx.ChunkOrder) == chunkOrderAny {
+		parallelism := numWorkers(ctx.ChunkParallelism, DefaultChunkParallelism)
+		remote, err := uploadChunksParallel(ctx, upload, file, fullPath, fi, offset, chunkSize, parallelism, sent)
+		if err != errChunkOutOfOrder {
+			return remote, err
+		}
+		atomic.StoreInt32(&ctx.ChunkOrder, chunkOrderRequired)
 
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println(err)
+		// continue from whatever girder received before the first chunk it refused
+		if offset, err = girder.UploadOffset(ctx, upload); err != nil {
+			return nil, unresumableError{fmt.Errorf("failed to upload %s, err: %s", fullPath, err)}
+		}
+	}
+	if parallel && atomic.LoadInt32(&ctx.ChunkOrder) == chunkOrderRequired {
+		ctx.Logger.Debugf("girder only accepts chunks in order, uploading %s one chunk at a time", fullPath)
+	}
+
+	var remote *chunkResponse
+	buffer := make([]byte, util.Min(chunkSize, fi.Size()-offset))
+	for ; offset < fi.Size(); offset += chunkSize {
+		remote, err = uploadChunk(ctx, upload, file, fullPath, fi, buffer, offset, chunkSize)
+		if err == errChunkOutOfOrder {
+			return nil, fmt.Errorf("failed to upload %s, err: girder refused the chunk at offset %d", fullPath, offset)
+		} else if err != nil && parallel {
+			// girder may have received chunks sent in parallel beyond offset
+			return nil, partialUploadError{err, offset}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if remote == nil {
+		return nil, nil
+	}
+	return &remote.GirderFile, nil
+}
+
+// errChunkOutOfOrder is returned when girder refuses a chunk because it hasn't received
+// all of those before it.
+var errChunkOutOfOrder = errors.New("chunk sent out of order")
+
+// uploadChunksParallel sends the chunks of file from offset onward with parallelism
+// workers, each reading its chunks into its own buffer, other than the chunks in sent which
+// girder already received. It returns errChunkOutOfOrder if girder requires chunks in order.
+func uploadChunksParallel(ctx *girder.Context, upload girder.GirderID, file *os.File, fullPath string, fi os.FileInfo, offset int64, chunkSize int64, parallelism int, sent map[int64]bool) (*girder.GirderFile, error) {
+	offsets := make(chan int64)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var remote *chunkResponse
+	var failure error
+	start := offset
+
+	for w := 1; w <= parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, chunkSize)
+			for chunkOffset := range offsets {
+				chunk, err := uploadChunk(ctx, upload, file, fullPath, fi, buffer, chunkOffset, chunkSize)
+				mutex.Lock()
+				if err != nil && failure == nil {
+					failure = err
+				} else if err == nil {
+					sent[chunkOffset] = true
+				}
+				if chunk != nil && chunk.Received == nil {
+					// only the response to the chunk which completes the upload is the file
+					remote = chunk
+				}
+				mutex.Unlock()
 			}
+		}()
+	}
 
+	for ; offset < fi.Size(); offset += chunkSize {
+		mutex.Lock()
+		failed, received := failure != nil, sent[offset]
+		mutex.Unlock()
+		if failed || ctx.Interrupted() {
 			break
+		} else if received {
+			continue
 		}
+		offsets <- offset
+	}
+	close(offsets)
+	wg.Wait()
+
+	// girder only knows how many bytes it has received, so an interrupted upload can be
+	// continued if it received every chunk up to some offset and none after it
+	contiguous := start
+	for sent[contiguous] {
+		contiguous += chunkSize
+	}
 
-		r := bytes.NewReader(buffer)
-		chunkOrFile := new(girder.GirderObject)
-		gerr := new(girder.GirderError)
+	if failure == errChunkOutOfOrder {
+		return nil, failure
+	} else if remote != nil {
+		return &remote.GirderFile, nil
+	} else if ctx.Interrupted() && int64(len(sent)) == (contiguous-start)/chunkSize {
+		return nil, partialUploadError{ctx.Ctx.Err(), contiguous}
+	} else if ctx.Interrupted() {
+		return nil, unresumableError{ctx.Ctx.Err()}
+	} else if failure != nil {
+		return nil, unresumableError{failure}
+	}
+	return nil, unresumableError{fmt.Errorf("girder didn't finish the upload of %s", fullPath)}
+}
 
-		if totalChunks > 1 {
-			ctx.Logger.Debugf("%s - uploading chunk %d/%d", fullPath, i, totalChunks)
-		}
-		_, err = girder.Post(ctx, fmt.Sprintf("file/chunk?uploadId=%s&offset=%d", upload, offset), r, chunkOrFile, gerr)
+// chunkResponse is how girder responds to a chunk, with the upload unless it was the
+// final chunk, in which case the file which was created.
+type chunkResponse struct {
+	girder.GirderFile
+	Received *int64 `json:"received"`
+}
 
-		offset, err = file.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			// handle error
-		}
+// uploadChunk reads the chunk of file at offset into buffer and sends it.
+func uploadChunk(ctx *girder.Context, upload girder.GirderID, file *os.File, fullPath string, fi os.FileInfo, buffer []byte, offset int64, chunkSize int64) (*chunkResponse, error) {
+	totalChunks := util.Max(1, (fi.Size()+chunkSize-1)/chunkSize)
+	i := offset/chunkSize + 1
+	buffer = buffer[:util.Min(chunkSize, fi.Size()-offset)]
+	if _, err := file.ReadAt(buffer, offset); err != nil {
+		return nil, fmt.Errorf("failed to read %s, err: %s", fullPath, err)
+	}
 
-		i++
-		if offset >= fi.Size() {
-			break
+	if totalChunks > 1 {
+		ctx.Logger.Debugf("%s - uploading chunk %d/%d", fullPath, i, totalChunks)
+	}
+	chunk := new(chunkResponse)
+	gerr := new(girder.GirderError)
+	// sent as a slice so retries reuse the buffer rather than copying it
+	_, err := girder.Post(ctx, fmt.Sprintf("file/chunk?uploadId=%s&offset=%d", upload, offset), buffer, chunk, gerr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload chunk %d of %s, err: %s", i, fullPath, err)
+	} else if girder.IsChunkOutOfOrder(gerr) {
+		return nil, errChunkOutOfOrder
+	} else if gerr.Message != "" {
+		return nil, fmt.Errorf("failed to upload chunk %d of %s, err: %s", i, fullPath, gerr.Message)
+	}
+
+	tracker(ctx).Add(fullPath, int64(len(buffer)))
+	emit(ctx, Event{Event: "chunk_uploaded", Path: fullPath, Size: int64(len(buffer)), Offset: offset, Chunk: i, Chunks: totalChunks})
+	return chunk, nil
+}
+
+// transferContents uploads the contents of fullPath to parentID, continuing a previous
+// upload if one was interrupted, otherwise starting a new one with initiate. The resulting
+// girder file is returned when known.
+func transferContents(ctx *girder.Context, state *uploadState, fullPath string, fi os.FileInfo, parentID girder.GirderID, initiate func() (girder.GirderID, error)) (*girder.GirderFile, error) {
+	uploadID, offset := state.resume(ctx, fullPath, fi, parentID)
+	if uploadID == "" {
+		var err error
+		if uploadID, err = initiate(); err != nil {
+			return nil, err
 		}
+		// girder finalizes empty files as soon as the upload is initiated
+		if fi.Size() == 0 {
+			return &girder.GirderFile{ID: uploadID}, nil
+		}
+		// files sent in a single chunk are as quick to upload again as to resume
+		if fi.Size() > uploadChunkSize(ctx) {
+			state.start(ctx, fullPath, fi, parentID, uploadID, sendsInParallel(ctx, fi.Size(), offset))
+		}
+	}
+	tracker(ctx).Start(fullPath, fi.Size(), offset)
+	defer tracker(ctx).End(fullPath)
+	emit(ctx, Event{Event: "upload_started", Path: fullPath, GirderID: parentID, Size: fi.Size(), Offset: offset})
+
+	file, err := _uploadBytes(ctx, uploadID, fullPath, fi, offset)
+	if _, ok := err.(unresumableError); ok {
+		// start over next time rather than continuing after a gap
+		state.finish(ctx, fullPath)
+		return nil, err
+	} else if partial, ok := err.(partialUploadError); ok {
+		state.stopped(ctx, fullPath, partial.received)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	state.finish(ctx, fullPath)
+	return file, nil
+}
+
+// uploadError combines the ways initiating an upload can fail into a single error.
+func uploadError(fullPath string, err error, gerr *girder.GirderError) error {
+	if err != nil {
+		return fmt.Errorf("failed to start upload of %s, err: %s", fullPath, err)
+	} else if gerr.Message != "" {
+		return fmt.Errorf("failed to start upload of %s, err: %s", fullPath, gerr.Message)
+	}
+	return nil
+}
+
+// uploadSymlink records the target of a preserved symbolic link in the metadata of its item.
+func uploadSymlink(ctx *girder.Context, resource *girder.Resource) int {
+	item, err := girder.GetItem(ctx, resource.GirderID)
+	if err != nil {
+		ctx.Logger.Errorf("failed to retrieve item for %s, err: %s", resource.Path, err)
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		return 0
+	}
+	if target, ok := item.Meta[symlinkMetaKey]; ok && target == resource.LinkTarget {
+		resource.Action, resource.ActionReason = "skip", "unchanged"
+		return 1
+	}
+
+	resource.Action, resource.ActionReason = "link", resource.LinkTarget
+	if ctx.DryRun {
+		return 1
+	}
+	ctx.Logger.Infof("linking: %s -> %s\n", resource.Path, resource.LinkTarget)
+	if err := girder.SetMetadata(ctx, "item", resource.GirderID, map[string]interface{}{symlinkMetaKey: resource.LinkTarget}); err != nil {
+		ctx.Logger.Errorf("failed to record symbolic link %s, err: %s", resource.Path, err)
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		return 0
+	}
+	return 1
+}
+
+// recordUpload remembers that fullPath is in sync with the remote file.
+func recordUpload(cache *syncCache, fullPath string, fi os.FileInfo, itemID girder.GirderID, remote *girder.GirderFile) {
+	synced := &syncedFile{Size: fi.Size(), ModTime: fi.ModTime(), ItemID: itemID}
+	if remote != nil {
+		synced.FileID, synced.Sha512 = remote.ID, remote.Sha512
 	}
+	cache.recordFile(fullPath, synced)
 }
 
-func uploadFile(ctx *girder.Context, parentID girder.GirderID, fullPath string, name string) int {
-	files := girder.ItemFiles(ctx, parentID)
+func uploadFile(ctx *girder.Context, state *uploadState, cache *syncCache, parentID girder.GirderID, fullPath string, name string) int {
+	resource := ctx.ResourceMap[fullPath]
+	if resource.LinkTarget != "" {
+		return uploadSymlink(ctx, resource)
+	}
+
 	upload := new(girder.GirderObject)
 	gerr := new(girder.GirderError)
 
 	fi, err := os.Stat(fullPath)
 	if err != nil {
-		ctx.Logger.Warnf("couldn't stat %s, skipping. err: %s", fullPath, err)
+		ctx.Logger.Errorf("couldn't stat %s, err: %s", fullPath, err)
+		resource.SkipSync, resource.SkipReason = true, err.Error()
+		return 0
+	}
+	files, err := girder.ItemFiles(ctx, parentID)
+	if err != nil {
+		ctx.Logger.Errorf("failed to list the files of %s, err: %s", fullPath, err)
+		resource.SkipSync, resource.SkipReason = true, fmt.Sprintf("failed to list the files of the item, err: %s", err)
 		return 0
 	}
-	if len(files) == 0 {
+
+	// the file being replaced, files within item directories being matched by name
+	var existing *girder.GirderFile
+	if inItemDir(ctx, resource) {
+		for i := range files {
+			if files[i].Name == name {
+				existing = &files[i]
+				break
+			}
+		}
+	} else if len(files) == 1 {
+		existing = &files[0]
+	} else if len(files) > 1 {
+		resource.Action, resource.ActionReason = "skip", "item has > 1 file"
+		ctx.Logger.Warnf("skipping sync of %s, item has > 1 file", fullPath)
+		return 1
+	}
+
+	if existing == nil {
+		resource.Action, resource.ActionReason = "upload", "new file"
+		if ctx.DryRun {
+			return 1
+		}
 		ctx.Logger.Debugf("detected new file %s\n", fullPath)
 		ctx.Logger.Infof("uploading: %s\n", fullPath)
 		// creating a new file
-		girder.Post(ctx, fmt.Sprintf("file?parentId=%s&name=%s&parentType=item&size=%d", parentID, url.QueryEscape(name), fi.Size()), nil, upload, nil)
-
-		_uploadBytes(ctx, upload.ID, fullPath, fi)
-	} else if len(files) == 1 {
+		remote, err := transferContents(ctx, state, fullPath, fi, parentID, func() (girder.GirderID, error) {
+			_, err := girder.Post(ctx, fmt.Sprintf("file?parentId=%s&name=%s&parentType=item&size=%d", parentID, url.QueryEscape(name), fi.Size()), nil, upload, gerr)
+			return upload.ID, uploadError(fullPath, err, gerr)
+		})
+		if err != nil {
+			resource.SkipSync, resource.SkipReason = true, err.Error()
+			ctx.Logger.Error(err)
+			return 0
+		}
+		recordUpload(cache, fullPath, fi, parentID, remote)
+	} else {
 		// potentially updating the contents of an existing file, or no-oping
 
-		if files[0].Size != fi.Size() {
-			ctx.Logger.Debugf("file sizes differ for %s\n", fullPath)
+		differ, reason, err := filesDiffer(ctx, fullPath, fi, *existing, true)
+		if err != nil {
+			ctx.Logger.Error(err)
+			resource.SkipSync, resource.SkipReason = true, err.Error()
+			return 0
+		}
+		if !differ {
+			resource.Action, resource.ActionReason = "skip", "unchanged"
+			recordUpload(cache, fullPath, fi, parentID, existing)
+		} else {
+			resource.Action, resource.ActionReason = "replace", reason
+			if ctx.DryRun {
+				return 1
+			}
+			ctx.Logger.Debugf("%s for %s\n", reason, fullPath)
 			ctx.Logger.Infof("uploading: %s\n", fullPath)
 			// change file contents
-			girder.Put(ctx, fmt.Sprintf("file/%s/contents?size=%d",
+			remote, err := transferContents(ctx, state, fullPath, fi, existing.ID, func() (girder.GirderID, error) {
+				_, err := girder.Put(ctx, fmt.Sprintf("file/%s/contents?size=%d",
 
-				files[0].ID, fi.Size()), nil, upload, gerr)
-
-			_uploadBytes(ctx, upload.ID, fullPath, fi)
+					existing.ID, fi.Size()), nil, upload, gerr)
+				return upload.ID, uploadError(fullPath, err, gerr)
+			})
+			if err != nil {
+				resource.SkipSync, resource.SkipReason = true, err.Error()
+				ctx.Logger.Error(err)
+				return 0
+			}
+			recordUpload(cache, fullPath, fi, parentID, remote)
 		}
-
-	} else {
-		fmt.Println("item has > 1 file.. not doing anything")
 	}
 
 	return 1
 }
 
-func shouldSkip(ctx *girder.Context, info os.FileInfo) bool {
-	// TODO skip symlinks
+// shouldSkip reports whether p, found beneath root, is excluded from the sync.
+func shouldSkip(ctx *girder.Context, root string, p string, info os.FileInfo) bool {
+	if !info.IsDir() && isPartialDownload(p) {
+		ctx.Logger.Debugf("skipping unfinished download %s", p)
+		return true
+	}
+	if !info.IsDir() && ctx.Metadata == MetadataSidecar && isSidecar(p) {
+		// synced as the metadata of the file or directory it belongs to
+		return true
+	}
 
+	relPath, err := filepath.Rel(root, p)
+	if err != nil || relPath == "." {
+		return false
+	}
+	if ctx.Filter.Excluded(filepath.ToSlash(relPath), info.IsDir()) {
+		ctx.Logger.Debugf("excluding %s", p)
+		ctx.NumExcluded++
+		return true
+	}
 	return false
 }
 
+// loadIgnoreFile adds the patterns of the ignore file within dir, if there is one.
+func loadIgnoreFile(ctx *girder.Context, root string, dir string) {
+	if ctx.Filter == nil {
+		return
+	}
+	ignoreFile := filepath.Join(dir, filter.IgnoreFileName)
+	file, err := os.Open(ignoreFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.Logger.Warnf("failed to read %s, err: %s", ignoreFile, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	relDir, _ := filepath.Rel(root, dir)
+	if err := ctx.Filter.AddIgnoreFile(filepath.ToSlash(relDir), file); err != nil {
+		ctx.Logger.Warnf("failed to parse %s, err: %s", ignoreFile, err)
+	}
+}
+
 func collectResources(ctx *girder.Context, localResources ...string) chan *girder.Resource {
 	ch := make(chan *girder.Resource)
 
@@ -136,24 +516,31 @@ func collectResources(ctx *girder.Context, localResources ...string) chan *girde
 			if err != nil {
 				ctx.Logger.Warnf("failed to stat %s, skipping", localResource)
 				continue
-			} else if shouldSkip(ctx, stat) {
-				continue
 			}
 
 			if !stat.IsDir() {
 				ch <- &girder.Resource{
-					Path: localResource,
-					Type: "file",
-					Size: stat.Size(),
+					Path:    localResource,
+					Type:    "file",
+					Size:    stat.Size(),
+					ModTime: stat.ModTime(),
 				}
 			} else {
-				err := filepath.Walk(localResource, func(filepath string, info os.FileInfo, err error) error {
-					if err != nil {
-						ctx.Logger.Warnf("failed to access %s, skipping", filepath)
-						return nil
-					} else if shouldSkip(ctx, info) {
+				err := walkLocal(ctx, localResource, func(p string, info os.FileInfo, linkTarget string) error {
+					if ctx.Interrupted() {
+						return ctx.Ctx.Err()
+					}
+					if shouldSkip(ctx, localResource, p, info) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
 						return nil
-					} else if filepath == "" || filepath == "." {
+					}
+
+					if info.IsDir() {
+						loadIgnoreFile(ctx, localResource, p)
+					}
+					if p == "" || p == "." {
 						return nil
 					}
 
@@ -163,10 +550,23 @@ func collectResources(ctx *girder.Context, localResources ...string) chan *girde
 					} else {
 						fileType = "file"
 					}
+					if ctx.ItemLayout == ItemLayoutDirectory {
+						if isItemDir(filepath.Dir(p)) && (info.IsDir() || linkTarget != "") {
+							ctx.Logger.Warnf("skipping %s, item directories may only contain files", p)
+							if info.IsDir() {
+								return filepath.SkipDir
+							}
+							return nil
+						} else if info.IsDir() && isItemDir(p) {
+							fileType = "item"
+						}
+					}
 					ch <- &girder.Resource{
-						Path: filepath,
-						Type: fileType,
-						Size: info.Size(),
+						Path:       p,
+						Type:       fileType,
+						Size:       info.Size(),
+						ModTime:    info.ModTime(),
+						LinkTarget: linkTarget,
 					}
 					return nil
 				})
@@ -198,7 +598,20 @@ func buildResourceMap(ctx *girder.Context, baseDir string) (int, int) {
 	return numDirs, numFiles
 }
 
-func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
+// isUnchanged reports whether a local file is the same as when it was last uploaded, in
+// which case girder doesn't need to be consulted about it.
+func isUnchanged(cache *syncCache, resource *girder.Resource) bool {
+	if resource.LinkTarget != "" {
+		return false
+	}
+	_, ok := cache.unchangedFile(resource.Path, resource.Size, resource.ModTime)
+	return ok
+}
+
+// Upload syncs the local directory source to the girder destination. An error is
+// returned if the sync couldn't be started, otherwise the result describes what
+// happened to each path.
+func Upload(ctx *girder.Context, source string, destination girder.GirderID) (*Result, error) {
 	ctx.Logger.Debugf("scanning %s for syncable items", source)
 
 	absSource, _ := filepath.Abs(source)
@@ -206,31 +619,65 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 	source = "."
 	numDirs, numFiles := buildResourceMap(ctx, source)
 	ctx.Logger.Infof("found %d dirs, %d files to potentially sync", numDirs, numFiles)
+	emit(ctx, Event{Event: "scan_complete", Dirs: numDirs, Files: numFiles, Excluded: ctx.NumExcluded})
+	if ctx.NumExcluded > 0 {
+		ctx.Logger.Infof("excluded %d files/folders", ctx.NumExcluded)
+	}
+	if ctx.Interrupted() {
+		ctx.Logger.Warn("interrupted while scanning, nothing was synced")
+		for _, resource := range ctx.ResourceMap {
+			skipIfInterrupted(ctx, resource)
+		}
+		result := newResult(ctx, nil)
+		emitSummary(ctx, result)
+		return result, nil
+	}
 
-	destFolder := new(girder.GirderObject)
-	httpErr := new(girder.GirderError)
-	resp, err := girder.Get(ctx, fmt.Sprintf("folder/%s", ctx.Destination), destFolder, httpErr)
+	startProgress(ctx, "uploading")
+	defer stopProgress(ctx)
+	for _, resource := range ctx.ResourceMap {
+		if resource.Type == "file" {
+			tracker(ctx).Plan(resource.Size)
+		}
+	}
 
-	if err != nil {
-		ctx.Logger.Fatalf("failed to retrieve destination folder, err: %s", err)
-	} else if resp.StatusCode != 200 {
-		ctx.Logger.Fatalf("failed to retrieve destination folder, err: %s", httpErr.Message)
+	// a dry run's destination which would be created is empty, so everything is new
+	missingDestination := ctx.DryRun && ctx.Destination == ""
+	if !missingDestination {
+		destFolder := new(girder.GirderObject)
+		httpErr := new(girder.GirderError)
+		resp, err := girder.Get(ctx, fmt.Sprintf("%s/%s", ctx.RootParentType(), ctx.Destination), destFolder, httpErr)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve destination %s, err: %s", ctx.RootParentType(), err)
+		} else if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to retrieve destination %s, err: %s", ctx.RootParentType(), httpErr.Message)
+		}
 	}
 
+	cache := loadSyncCache(ctx, source, girder.GirderID(ctx.Destination), "upload")
+
 	ctx.Logger.Info("building remote girder directories")
-	buildGirderDirs(ctx, source)
+	buildGirderDirs(ctx, cache)
 
 	ctx.Logger.Info("building remote girder items")
 
 	numJobs := 0
 	var mutex sync.Mutex
-	itemsToUpload := make(chan *girder.PathAndResource, numFiles)
-	results := make(chan bool, numFiles)
+	itemsToUpload := make(chan *girder.PathAndResource, len(ctx.ResourceMap))
+	results := make(chan bool, len(ctx.ResourceMap))
 
-	// spawn 10 workers for building items
-	for w := 1; w <= 10; w++ {
+	for w := 1; w <= numWorkers(ctx.Workers, DefaultWorkers); w++ {
 		go func() {
 			for pathAndResource := range itemsToUpload {
+				mutex.Lock()
+				interrupted := skipIfInterrupted(ctx, pathAndResource.Resource)
+				mutex.Unlock()
+				if interrupted {
+					emitOutcome(ctx, pathAndResource.Resource)
+					results <- true
+					continue
+				}
 				parent := ctx.ResourceMap.Parent(pathAndResource.Resource)
 
 				// default to the root sync dest, override if there's a parent
@@ -238,16 +685,46 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 				if parent != nil {
 					parentID = parent.GirderID
 				}
+				if parent == nil && ctx.RootParentType() != "folder" {
+					reason := fmt.Sprintf("files can't be stored directly in a girder %s, only in its folders", ctx.RootParentType())
+					mutex.Lock()
+					ctx.ResourceMap[pathAndResource.Path].SkipSync = true
+					ctx.ResourceMap[pathAndResource.Path].SkipReason = reason
+					mutex.Unlock()
+					ctx.Logger.Warnf("skipping sync of %s, %s", pathAndResource.Path, reason)
+					emitOutcome(ctx, pathAndResource.Resource)
+					results <- true
+					continue
+				}
 				if parent != nil && parent.SkipSync {
 					mutex.Lock()
 					ctx.ResourceMap[pathAndResource.Path].SkipSync = true
 					ctx.ResourceMap[pathAndResource.Path].SkipReason = parent.SkipReason
 					mutex.Unlock()
 					ctx.Logger.Warnf("skipping sync of %s because parent failed to be created", parent.Path)
+					emitOutcome(ctx, pathAndResource.Resource)
+					results <- true
+					continue
+				}
+				if pathAndResource.Resource.Type == "item" {
+					createItemDir(ctx, &mutex, cache, parentID, pathAndResource.Resource)
+					emitOutcome(ctx, pathAndResource.Resource)
 					results <- true
 					continue
 				}
-				itemID, err := girder.GetOrCreateItem(ctx, parentID, filepath.Base(pathAndResource.Path))
+				if isUnchanged(cache, pathAndResource.Resource) {
+					synced, _ := cache.unchangedFile(pathAndResource.Path, pathAndResource.Resource.Size, pathAndResource.Resource.ModTime)
+					mutex.Lock()
+					ctx.ResourceMap[pathAndResource.Path].GirderID = synced.ItemID
+					ctx.ResourceMap[pathAndResource.Path].Action = "skip"
+					ctx.ResourceMap[pathAndResource.Path].ActionReason = "unchanged since last sync"
+					mutex.Unlock()
+					cache.recordFile(pathAndResource.Path, synced)
+					emitOutcome(ctx, pathAndResource.Resource)
+					results <- true
+					continue
+				}
+				itemID, created, err := girder.GetOrCreateItem(ctx, parentID, filepath.Base(pathAndResource.Path))
 				mutex.Lock()
 				if err != nil {
 					ctx.ResourceMap[pathAndResource.Path].SkipSync = true
@@ -257,13 +734,17 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 					ctx.ResourceMap[pathAndResource.Path].GirderID = itemID
 				}
 				mutex.Unlock()
+				if err == nil && created {
+					emit(ctx, Event{Event: "item_created", Path: pathAndResource.Path, GirderID: itemID})
+				}
+				emitOutcome(ctx, pathAndResource.Resource)
 				results <- true
 			}
 		}()
 	}
 
 	for filepath, resource := range ctx.ResourceMap {
-		if resource.Type == "file" {
+		if (resource.Type == "file" && !inItemDir(ctx, resource)) || resource.Type == "item" {
 			f := new(girder.PathAndResource)
 			f.Path = filepath
 			f.Resource = resource
@@ -277,18 +758,38 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 		<-results
 	}
 
+	// files within item directories belong to the item rather than having their own
+	for _, resource := range ctx.ResourceMap {
+		if resource.Type != "file" || !inItemDir(ctx, resource) {
+			continue
+		}
+		if parent := ctx.ResourceMap.Parent(resource); parent.SkipSync {
+			resource.SkipSync, resource.SkipReason = true, parent.SkipReason
+		} else {
+			resource.GirderID = parent.GirderID
+		}
+		if isUnchanged(cache, resource) {
+			resource.Action, resource.ActionReason = "skip", "unchanged since last sync"
+		}
+	}
+
 	ctx.Logger.Info("syncing blobs")
 
 	numJobs = 0
 	filesToUpload := make(chan *girder.PathAndResource, numFiles)
 	results = make(chan bool, numFiles)
 
-	// spawn 10 workers for uploading files
-	for w := 1; w <= 10; w++ {
+	state := loadUploadState(ctx)
+
+	for w := 1; w <= numWorkers(ctx.Workers, DefaultWorkers); w++ {
 		go func() {
 			for pathAndResource := range filesToUpload {
+				if pathAndResource != nil && !skipIfInterrupted(ctx, pathAndResource.Resource) {
+					uploadFile(ctx, state, cache, pathAndResource.Resource.GirderID, pathAndResource.Path, path.Base(pathAndResource.Path))
+					emitOutcome(ctx, pathAndResource.Resource)
+				}
 				if pathAndResource != nil {
-					uploadFile(ctx, pathAndResource.Resource.GirderID, pathAndResource.Path, path.Base(pathAndResource.Path))
+					tracker(ctx).Finish(pathAndResource.Resource)
 				}
 				results <- true
 			}
@@ -296,15 +797,23 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 	}
 
 	for filepath, resource := range ctx.ResourceMap {
-		if resource.Type == "file" && resource.GirderID != "" {
+		if resource.Type == "file" && isUnchanged(cache, resource) {
+			tracker(ctx).Finish(resource)
+			continue
+		} else if resource.Type == "file" && resource.GirderID != "" {
 			f := new(girder.PathAndResource)
 			f.Path = filepath
 			f.Resource = resource
 			numJobs++
 			filesToUpload <- f
+		} else if resource.Type == "file" && resource.GirderID == "" && ctx.DryRun && !resource.SkipSync {
+			resource.Action, resource.ActionReason = "upload", "new item"
 		} else if resource.Type == "file" && resource.GirderID == "" {
 			// it was printed as an error above
-			ctx.Logger.Infof("skipping sync of %s because parent item creation failed.", filepath)
+			if !wasInterrupted(ctx, resource) {
+				ctx.Logger.Infof("skipping sync of %s because parent item creation failed.", filepath)
+			}
+			tracker(ctx).Finish(resource)
 			numJobs++
 			filesToUpload <- nil
 		}
@@ -315,34 +824,26 @@ func Upload(ctx *girder.Context, source string, destination girder.GirderID) {
 		<-results
 	}
 
-	ctx.Logger.Info("")
+	uploadSidecars(ctx, cache)
 
-	ctx.Logger.Info("summary:")
-
-	var numSucceeded int
-	var numFailed int
-
-	failureSummary := make([]string, 0)
-	for k, v := range ctx.ResourceMap {
-		if v.SkipSync {
-			numFailed++
-			failureSummary = append(failureSummary, fmt.Sprintf("%s: %s", k, v.SkipReason))
-		} else {
-			numSucceeded++
-		}
+	// deleting comes last, so a sync which fails or is interrupted partway hasn't
+	// already removed anything from girder
+	var deleted []string
+	var deleteFailures []Outcome
+	if ctx.Delete && !missingDestination && !ctx.Interrupted() {
+		ctx.Logger.Info("removing remote files not present locally")
+		deleted, deleteFailures = deleteRemoteResources(ctx, girder.GirderID(ctx.Destination))
 	}
 
-	sort.Slice(failureSummary, func(i, j int) bool { return failureSummary[i] < failureSummary[j] })
-
-	ctx.Logger.Infof("successfully synced %d files/folders", numSucceeded)
-
-	if numFailed > 0 {
-		ctx.Logger.Infof("failed to sync %d files/folders:", numFailed)
-
-		for _, failure := range failureSummary {
-			ctx.Logger.Info(failure)
-		}
+	stopProgress(ctx)
+	result := newResult(ctx, deleted)
+	result.Failed = append(result.Failed, deleteFailures...)
+	if ctx.DryRun {
+		printPlan(ctx, deleted)
+	} else {
+		cache.save(ctx)
+		printSummary(ctx, result)
 	}
-
-	return
+	emitSummary(ctx, result)
+	return result, nil
 }
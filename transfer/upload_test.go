@@ -1,7 +1,18 @@
 package transfer
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/danlamanna/rivet/girder"
@@ -54,7 +65,6 @@ func Test_collectResources(t *testing.T) {
 				{Path: "../etc/testdata/mixed/a", Type: "directory", Size: 4096},
 				{Path: "../etc/testdata/mixed/a/b", Type: "directory", Size: 4096},
 				{Path: "../etc/testdata/mixed/a/inner_file", Type: "file", Size: 4},
-				{Path: "../etc/testdata/mixed/a_symlink", Type: "file", Size: 8},
 				{Path: "../etc/testdata/mixed/root_file", Type: "file", Size: 0},
 			},
 		},
@@ -83,3 +93,231 @@ func Test_collectResources(t *testing.T) {
 		})
 	}
 }
+
+// chunkServer is a girder which receives the chunks of a single upload, either in any
+// order like a multipart assetstore or only in order like a filesystem assetstore. It
+// returns functions reporting what it received and how many chunks it refused.
+func chunkServer(t *testing.T, size int64, inOrder bool) (*httptest.Server, func() []byte, func() int) {
+	var mutex sync.Mutex
+	parts := make(map[int64][]byte)
+	received := int64(0)
+	refused := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasSuffix(r.URL.Path, "file/offset") {
+			fmt.Fprintf(w, `{"offset": %d}`, received)
+			return
+		}
+		offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		body, _ := ioutil.ReadAll(r.Body)
+		if inOrder && offset != received {
+			refused++
+			w.WriteHeader(400)
+			fmt.Fprintf(w, `{"message": "Server has received %d bytes, but client sent offset %d."}`, received, offset)
+			return
+		}
+		parts[offset] = body
+		received += int64(len(body))
+		if received == size {
+			json.NewEncoder(w).Encode(map[string]interface{}{"_id": "file", "size": size})
+		} else {
+			json.NewEncoder(w).Encode(map[string]interface{}{"_id": "upload", "received": received})
+		}
+	}))
+	assembled := func() []byte {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var contents []byte
+		for offset := int64(0); offset < size; offset += int64(len(parts[offset])) {
+			contents = append(contents, parts[offset]...)
+		}
+		return contents
+	}
+	return server, assembled, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return refused
+	}
+}
+
+func Test_uploadBytesParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	fullPath := filepath.Join(dir, "f")
+	ioutil.WriteFile(fullPath, contents, 0644)
+	fi, _ := os.Stat(fullPath)
+
+	for _, inOrder := range []bool{false, true} {
+		server, received, refused := chunkServer(t, fi.Size(), inOrder)
+		var logs bytes.Buffer
+		logger := logrus.New()
+		logger.Out = &logs
+		ctx := &girder.Context{
+			URL:              server.URL,
+			Logger:           logger,
+			ChunkSize:        512,
+			ChunkParallelism: 4,
+		}
+		ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+
+		remote, err := _uploadBytes(ctx, "upload", fullPath, fi, 0)
+		server.Close()
+		if err != nil {
+			t.Fatalf("_uploadBytes() in order %v failed, err: %s", inOrder, err)
+		} else if remote == nil || remote.ID != "file" {
+			t.Errorf("_uploadBytes() in order %v = %v, want the file", inOrder, remote)
+		}
+		if !bytes.Equal(received(), contents) {
+			t.Errorf("girder received different contents with chunks in order %v", inOrder)
+		}
+		if rejected := ctx.ChunkOrder == chunkOrderRequired; rejected != inOrder {
+			t.Errorf("chunks were rejected = %v, want %v", rejected, inOrder)
+		}
+		// only a single chunk is sent to find out whether girder requires them in order
+		if inOrder && refused() != 1 {
+			t.Errorf("girder refused %d chunks, want 1", refused())
+		}
+		if strings.Contains(logs.String(), "level=warning") {
+			t.Errorf("chunks refused for being out of order were warned about:\n%s", logs.String())
+		}
+	}
+}
+
+func Test_uploadFileFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listed := filepath.Join(dir, "listed")
+	ioutil.WriteFile(listed, []byte("contents"), 0644)
+	missing := filepath.Join(dir, "missing")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"message": "something went wrong"}`)
+	}))
+	defer server.Close()
+	ctx := &girder.Context{
+		URL:    server.URL,
+		Logger: logrus.New(),
+		ResourceMap: girder.ResourceMap{
+			listed:  {Path: listed, Type: "file", GirderID: "item1"},
+			missing: {Path: missing, Type: "file", GirderID: "item2"},
+		},
+	}
+	ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+
+	// the local file disappearing and girder failing to list the item's files are failures
+	for p, resource := range ctx.ResourceMap {
+		if uploadFile(ctx, nil, nil, resource.GirderID, p, filepath.Base(p)) != 0 {
+			t.Errorf("uploadFile(%s) succeeded", p)
+		}
+	}
+	result := newResult(ctx, nil)
+	if len(result.Failed) != 2 || len(result.Succeeded) != 0 || result.OK() {
+		t.Errorf("Failed = %v, Succeeded = %v, want both files to fail", result.Failed, result.Succeeded)
+	}
+}
+
+// cancelAfterChunks cancels a sync once it has emitted the events of uploading chunks.
+type cancelAfterChunks struct {
+	sync.Mutex
+	chunks int
+	cancel func()
+}
+
+func (c *cancelAfterChunks) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if bytes.Contains(p, []byte(`"chunk_uploaded"`)) {
+		if c.chunks--; c.chunks == 0 {
+			c.cancel()
+		}
+	}
+	return len(p), nil
+}
+
+func Test_transferContentsParallelInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := bytes.Repeat([]byte("0123456789"), 300)
+	fullPath := filepath.Join(dir, "f")
+	ioutil.WriteFile(fullPath, contents, 0644)
+	fi, _ := os.Stat(fullPath)
+	const chunkSize = 512
+
+	tests := []struct {
+		name string
+		// gap is whether girder receives the chunk after the one being sent when the
+		// sync is interrupted, without rivet knowing
+		gap        bool
+		wantResume bool
+	}{
+		{"received in order", false, true},
+		{"received with a gap", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, cancel := context.WithCancel(context.Background())
+			var mutex sync.Mutex
+			received := int64(0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "file/offset") {
+					mutex.Lock()
+					fmt.Fprintf(w, `{"offset": %d}`, received)
+					mutex.Unlock()
+					return
+				}
+				offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+				body, _ := ioutil.ReadAll(r.Body)
+				if offset == 2*chunkSize || (offset > 2*chunkSize && !tt.gap) {
+					// still being sent when the sync is interrupted
+					<-r.Context().Done()
+					return
+				}
+				mutex.Lock()
+				received += int64(len(body))
+				mutex.Unlock()
+				if offset > 2*chunkSize {
+					// received, but the sync is interrupted before rivet hears so
+					cancel()
+					<-r.Context().Done()
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"_id": "upload", "received": received})
+			}))
+			defer server.Close()
+			ctx := &girder.Context{URL: server.URL, Logger: logrus.New(), Ctx: c, ChunkSize: chunkSize, ChunkParallelism: 2}
+			ctx.Client = girder.NewClient(ctx, girder.ClientOptions{Retries: 0})
+			if !tt.gap {
+				// interrupted once rivet knows the first two chunks were received
+				ctx.Events = girder.NewEventStream(&cancelAfterChunks{chunks: 2, cancel: cancel})
+			}
+			state := &uploadState{uploads: make(map[string]*pendingUpload)}
+
+			_, err := transferContents(ctx, state, fullPath, fi, "item", func() (girder.GirderID, error) {
+				return "upload", nil
+			})
+			if err == nil {
+				t.Fatal("transferContents() succeeded after being interrupted")
+			}
+
+			ctx.Ctx = context.Background()
+			uploadID, offset := state.resume(ctx, fullPath, fi, "item")
+			if tt.wantResume && (uploadID != "upload" || offset != 2*chunkSize) {
+				t.Errorf("resume() = %q, %d, want the upload at %d", uploadID, offset, 2*chunkSize)
+			} else if !tt.wantResume && uploadID != "" {
+				t.Errorf("resume() = %q, %d, want to start over", uploadID, offset)
+			}
+		})
+	}
+}
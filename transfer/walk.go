@@ -0,0 +1,120 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danlamanna/rivet/girder"
+)
+
+const (
+	SymlinksSkip     = "skip"
+	SymlinksFollow   = "follow"
+	SymlinksPreserve = "preserve"
+)
+
+// symlinkMetaKey is the item metadata key storing the target of a preserved symbolic link.
+const symlinkMetaKey = "rivet_symlink_target"
+
+// walkFunc is called for every path found by walkLocal. For followed symbolic links info
+// describes the target, for preserved ones linkTarget is where the link points. Returning
+// filepath.SkipDir for a directory skips its contents.
+type walkFunc func(p string, info os.FileInfo, linkTarget string) error
+
+// walkLocal walks the tree rooted at root in lexical order like filepath.Walk, handling
+// symbolic links according to the symlink policy of the context. Paths which are skipped,
+// or whose contents couldn't be read, are recorded in ctx.Unwalked.
+func walkLocal(ctx *girder.Context, root string, fn walkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	return walkPath(ctx, root, info, "", make(map[string]bool), fn)
+}
+
+func walkPath(ctx *girder.Context, p string, info os.FileInfo, linkTarget string, ancestors map[string]bool, fn walkFunc) error {
+	err := fn(p, info, linkTarget)
+	if !info.IsDir() {
+		return nil
+	} else if err == filepath.SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// track the real path of every directory being walked so following a link
+	// back to one of them can be detected
+	dirRealPath, err := realPath(p)
+	if err != nil {
+		ctx.Logger.Warnf("failed to resolve %s, skipping. err: %s", p, err)
+		markUnwalked(ctx, p)
+		return nil
+	}
+	ancestors[dirRealPath] = true
+	defer delete(ancestors, dirRealPath)
+
+	entries, err := ioutil.ReadDir(p)
+	if err != nil {
+		ctx.Logger.Warnf("failed to access %s, skipping", p)
+		markUnwalked(ctx, p)
+		return nil
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(p, entry.Name())
+		entryInfo, target := entry, ""
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			switch ctx.Symlinks {
+			case SymlinksFollow:
+				entryInfo, err = os.Stat(entryPath)
+				if err != nil {
+					ctx.Logger.Warnf("failed to follow symbolic link %s, skipping. err: %s", entryPath, err)
+					markUnwalked(ctx, entryPath)
+					continue
+				}
+				if entryInfo.IsDir() {
+					if entryReal, err := realPath(entryPath); err == nil && ancestors[entryReal] {
+						ctx.Logger.Warnf("symbolic link %s creates a cycle, skipping", entryPath)
+						markUnwalked(ctx, entryPath)
+						continue
+					}
+				}
+			case SymlinksPreserve:
+				target, err = os.Readlink(entryPath)
+				if err != nil {
+					ctx.Logger.Warnf("failed to read symbolic link %s, skipping. err: %s", entryPath, err)
+					markUnwalked(ctx, entryPath)
+					continue
+				}
+			default:
+				ctx.Logger.Debugf("skipping symbolic link %s", entryPath)
+				markUnwalked(ctx, entryPath)
+				continue
+			}
+		}
+
+		if err := walkPath(ctx, entryPath, entryInfo, target, ancestors, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markUnwalked records that p, or its contents, weren't walked, so whatever is at p in
+// the destination isn't known to be extraneous.
+func markUnwalked(ctx *girder.Context, p string) {
+	if ctx.Unwalked == nil {
+		ctx.Unwalked = make(map[string]bool)
+	}
+	ctx.Unwalked[filepath.ToSlash(p)] = true
+}
+
+func realPath(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
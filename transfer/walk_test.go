@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/danlamanna/rivet/girder"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_walkLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "file"), []byte("abcd"), 0644)
+	os.Symlink("file", filepath.Join(dir, "a", "file_link"))
+	os.Symlink("..", filepath.Join(dir, "a", "cycle"))
+	os.Symlink("nonexistent", filepath.Join(dir, "dangling"))
+
+	tests := []struct {
+		symlinks string
+		want     []string
+		unwalked []string
+	}{
+		{SymlinksSkip, []string{".", "a", "a/file"}, []string{"a/cycle", "a/file_link", "dangling"}},
+		{SymlinksFollow, []string{".", "a", "a/file", "a/file_link"}, []string{"a/cycle", "dangling"}},
+		{SymlinksPreserve, []string{".", "a", "a/cycle -> ..", "a/file", "a/file_link -> file", "dangling -> nonexistent"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symlinks, func(t *testing.T) {
+			ctx := &girder.Context{Logger: logrus.New(), Symlinks: tt.symlinks}
+			got := make([]string, 0)
+			err := walkLocal(ctx, dir, func(p string, info os.FileInfo, linkTarget string) error {
+				relPath, _ := filepath.Rel(dir, p)
+				if linkTarget != "" {
+					relPath += " -> " + linkTarget
+				}
+				got = append(got, filepath.ToSlash(relPath))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("walkLocal() = %v, want %v", got, tt.want)
+			}
+
+			// skipped links are recorded so --delete leaves them alone
+			unwalked := make([]string, 0)
+			for p := range ctx.Unwalked {
+				relPath, _ := filepath.Rel(dir, p)
+				unwalked = append(unwalked, filepath.ToSlash(relPath))
+			}
+			sort.Strings(unwalked)
+			if !reflect.DeepEqual(unwalked, tt.unwalked) {
+				t.Errorf("walkLocal() left %v unwalked, want %v", unwalked, tt.unwalked)
+			}
+		})
+	}
+}
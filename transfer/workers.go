@@ -0,0 +1,20 @@
+package transfer
+
+// DefaultWorkers is how many items are created, files transferred, and metadata synced
+// at once, and DefaultFolderWorkers how many folders at the same depth are created at
+// once, unless configured otherwise. DefaultChunkParallelism is how many chunks of a
+// single file are uploaded at once, each DefaultChunkSize bytes.
+const (
+	DefaultWorkers          = 10
+	DefaultFolderWorkers    = 4
+	DefaultChunkParallelism = 1
+	DefaultChunkSize        = 16 * 1024 * 1024
+)
+
+// numWorkers returns n, or def if n wasn't configured.
+func numWorkers(n int, def int) int {
+	if n < 1 {
+		return def
+	}
+	return n
+}
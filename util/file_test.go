@@ -0,0 +1,33 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_WriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rivet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config", "f.json")
+
+	for _, contents := range []string{"first", "second"} {
+		if err := WriteFileAtomic(file, []byte(contents), 0600); err != nil {
+			t.Fatalf("WriteFileAtomic() failed, err: %s", err)
+		}
+		if got, _ := ioutil.ReadFile(file); string(got) != contents {
+			t.Errorf("file = %q, want %q", got, contents)
+		}
+	}
+	if st, err := os.Stat(file); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, %v, want 0600", st.Mode().Perm(), err)
+	}
+	// nothing but the file is left behind
+	if entries, _ := ioutil.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Errorf("%d files were written, want 1", len(entries))
+	}
+}
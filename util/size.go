@@ -0,0 +1,30 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a number of bytes such as 512K, 16M, or 1.5G, the suffixes being
+// powers of 1024. A trailing B or iB is allowed, e.g. 16MB or 16MiB.
+func ParseSize(s string) (int64, error) {
+	number := strings.TrimSpace(s)
+	number = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(number), "B"), "I")
+
+	multiplier := int64(1)
+	if number != "" {
+		if exp := strings.IndexByte("KMGT", number[len(number)-1]); exp != -1 {
+			for ; exp >= 0; exp-- {
+				multiplier *= 1024
+			}
+			number = number[:len(number)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes such as 512K, 16M, or 1G", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,30 @@
+package util
+
+import "testing"
+
+func Test_ParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"100", 100, false},
+		{"512K", 512 * 1024, false},
+		{"16M", 16 * 1024 * 1024, false},
+		{"16m", 16 * 1024 * 1024, false},
+		{"16MB", 16 * 1024 * 1024, false},
+		{"16MiB", 16 * 1024 * 1024, false},
+		{"1.5G", 1536 * 1024 * 1024, false},
+		{"2T", 2 * 1024 * 1024 * 1024 * 1024, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1M", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d (error %v)", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// IsTerminal reports whether f is a terminal rather than a file or pipe.
+func IsTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// TerminalWidth returns the number of columns of the terminal f, or 0 if f isn't a
+// terminal.
+func TerminalWidth(f *os.File) int {
+	width, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// ReadLine reads a line from r without reading past it, so whatever follows is left for
+// the next read, trimming surrounding whitespace.
+func ReadLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// ReadPassword prompts for a password on stderr, reading it from stdin without echoing
+// it if stdin is a terminal.
+func ReadPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	// the newline typed after the password isn't echoed either
+	defer fmt.Fprintln(os.Stderr)
+	if IsTerminal(os.Stdin) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return strings.TrimSpace(string(password)), err
+	}
+	return ReadLine(os.Stdin)
+}